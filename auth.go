@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing/client/common"
+)
+
+// GitAuth configures how repositories are fetched.
+// Without it SSH URIs use the SSH agent and HTTPS URIs the credentials in the URI, if any.
+type GitAuth struct {
+	// SSHKey is a private key file, used instead of the SSH agent.
+	SSHKey string `yaml:"sshKey,omitempty"`
+	// SSHKeyPassphraseVar names the environment variable with the passphrase of SSHKey.
+	SSHKeyPassphraseVar string `yaml:"sshKeyPassphraseVar,omitempty"`
+	// KnownHosts is the known_hosts file host keys are checked against. Defaults to ~/.ssh/known_hosts.
+	KnownHosts string `yaml:"knownHosts,omitempty"`
+	// HostKeyCheck is "strict" or "accept-new". Host keys are not checked if neither it nor KnownHosts is set.
+	HostKeyCheck string `yaml:"hostKeyCheck,omitempty"`
+	// UsernameVar, PasswordVar and TokenVar name the environment variables used for HTTPS basic auth.
+	UsernameVar string `yaml:"usernameVar,omitempty"`
+	PasswordVar string `yaml:"passwordVar,omitempty"`
+	TokenVar    string `yaml:"tokenVar,omitempty"`
+}
+
+const (
+	hostKeyStrict    = "strict"
+	hostKeyAcceptNew = "accept-new"
+)
+
+// gitAuthFor returns the auth settings for an endpoint: the ones of the repository with that URI on top of the global ones.
+func gitAuthFor(endpoint common.Endpoint) GitAuth {
+	var auth GitAuth
+	if config == nil {
+		return auth
+	}
+	if config.Auth != nil {
+		auth = *config.Auth
+	}
+
+	repos := config.Repositories
+	for _, target := range config.Targets {
+		repos = append(repos, target.Repositories...)
+	}
+	for _, repo := range repos {
+		if repo.Auth == nil || !sameEndpoint(repo.URI, endpoint) {
+			continue
+		}
+		override := *repo.Auth
+		for _, field := range []struct{ dst, src *string }{
+			{&auth.SSHKey, &override.SSHKey},
+			{&auth.SSHKeyPassphraseVar, &override.SSHKeyPassphraseVar},
+			{&auth.KnownHosts, &override.KnownHosts},
+			{&auth.HostKeyCheck, &override.HostKeyCheck},
+			{&auth.UsernameVar, &override.UsernameVar},
+			{&auth.PasswordVar, &override.PasswordVar},
+			{&auth.TokenVar, &override.TokenVar},
+		} {
+			if *field.src != "" {
+				*field.dst = *field.src
+			}
+		}
+		break
+	}
+
+	return auth
+}
+
+func sameEndpoint(uri string, endpoint common.Endpoint) bool {
+	e, err := common.NewEndpoint(uri)
+	if err != nil {
+		return false
+	}
+
+	return e.String() == endpoint.String()
+}
+
+// basicAuth returns the HTTPS credentials and a description of where they came from.
+// A token is sent as the password, with the user from UsernameVar or "oauth2".
+func (a GitAuth) basicAuth(endpoint common.Endpoint) (string, string, string, error) {
+	user := ""
+	if a.UsernameVar != "" {
+		user = os.Getenv(a.UsernameVar)
+		if user == "" {
+			return "", "", "", fmt.Errorf("$%s is not set", a.UsernameVar)
+		}
+	}
+
+	switch {
+	case a.TokenVar != "":
+		token := os.Getenv(a.TokenVar)
+		if token == "" {
+			return "", "", "", fmt.Errorf("$%s is not set", a.TokenVar)
+		}
+		if user == "" {
+			user = "oauth2"
+		}
+		return user, token, "token from $" + a.TokenVar, nil
+	case a.PasswordVar != "":
+		password := os.Getenv(a.PasswordVar)
+		if password == "" {
+			return "", "", "", fmt.Errorf("$%s is not set", a.PasswordVar)
+		}
+		return user, password, "password from $" + a.PasswordVar, nil
+	case endpoint.User != nil:
+		password, _ := endpoint.User.Password()
+		return endpoint.User.Username(), password, "credentials in the URI", nil
+	}
+
+	return "", "", "no credentials", nil
+}
+
+// sshKeySigner reads the private key in SSHKey, decrypting it with the passphrase if it has one.
+func (a GitAuth) sshKeySigner() (ssh.Signer, error) {
+	keyBytes, err := ioutil.ReadFile(a.SSHKey)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM encoded key found")
+	}
+
+	passphrase := ""
+	if a.SSHKeyPassphraseVar != "" {
+		passphrase = os.Getenv(a.SSHKeyPassphraseVar)
+	}
+
+	if x509.IsEncryptedPEMBlock(block) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("The key is encrypted and no passphrase was given in sshKeyPassphraseVar")
+		}
+		der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decrypt the key with the passphrase from $%s: %s", a.SSHKeyPassphraseVar, err)
+		}
+		keyBytes = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	} else if block.Type == "OPENSSH PRIVATE KEY" && openSSHKeyEncrypted(block.Bytes) {
+		return nil, fmt.Errorf("Encrypted keys in the OpenSSH format are not supported, convert it to PEM with ssh-keygen -p -m PEM")
+	}
+
+	return ssh.ParsePrivateKey(keyBytes)
+}
+
+// openSSHKeyEncrypted reports whether a key in the OpenSSH format uses a cipher.
+func openSSHKeyEncrypted(key []byte) bool {
+	magic := []byte("openssh-key-v1\x00")
+	if !bytes.HasPrefix(key, magic) || len(key) < len(magic)+4 {
+		return false
+	}
+	rest := key[len(magic):]
+	n := binary.BigEndian.Uint32(rest)
+
+	return uint32(len(rest)-4) >= n && string(rest[4:4+n]) != "none"
+}
+
+var knownHostsMu sync.Mutex
+
+var knownHostsEscaper = strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`)
+
+// hostKeyCallback checks host keys against the known_hosts file.
+// In accept-new mode keys of hosts that are not in the file yet are added to it.
+func (a GitAuth) hostKeyCallback() (func(string, net.Addr, ssh.PublicKey) error, error) {
+	mode := a.HostKeyCheck
+	if mode == "" && a.KnownHosts == "" {
+		return nil, nil
+	}
+	if mode == "" {
+		mode = hostKeyStrict
+	}
+	if mode != hostKeyStrict && mode != hostKeyAcceptNew {
+		return nil, fmt.Errorf("Unknown hostKeyCheck %q, use %q or %q", mode, hostKeyStrict, hostKeyAcceptNew)
+	}
+	file := a.KnownHosts
+	if file == "" {
+		file = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+
+		host := knownHostsName(hostname)
+		known, err := knownHostKeys(file, host)
+		if err != nil {
+			return err
+		}
+		for _, k := range known {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+		if len(known) > 0 {
+			return fmt.Errorf("Host key %s %s of %s does not match the one in %s", key.Type(), ssh.FingerprintSHA256(key), host, file)
+		}
+		if mode == hostKeyStrict {
+			return fmt.Errorf("Host %s is not in %s, add it with ssh-keyscan", host, file)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = fmt.Fprintf(f, "%s %s", host, ssh.MarshalAuthorizedKey(key))
+
+		return err
+	}, nil
+}
+
+// knownHostsName returns how a host appears in known_hosts: "host" for port 22, "[host]:port" otherwise.
+func knownHostsName(hostname string) string {
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		return hostname
+	}
+	if port == "22" {
+		return host
+	}
+
+	return "[" + host + "]:" + port
+}
+
+// knownHostKeys returns the keys listed in a known_hosts file for a host.
+// A revoked key matching the host is an error.
+func knownHostKeys(file, host string) ([]ssh.PublicKey, error) {
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ssh.PublicKey
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 || bytes.HasPrefix(bytes.TrimSpace(line), []byte("#")) {
+			continue
+		}
+		marker, hosts, key, _, _, err := ssh.ParseKnownHosts(line)
+		if err != nil {
+			// Skip lines with key types we don't know
+			continue
+		}
+		if !knownHostsMatch(hosts, host) {
+			continue
+		}
+		switch marker {
+		case "revoked":
+			return nil, fmt.Errorf("Host key %s of %s is revoked in %s", ssh.FingerprintSHA256(key), host, file)
+		case "cert-authority":
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, scanner.Err()
+}
+
+// knownHostsMatch reports whether host matches the patterns of a known_hosts line,
+// which can be plain, hashed (|1|salt|hash) or wildcard patterns, negated with "!".
+func knownHostsMatch(patterns []string, host string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var ok bool
+		if strings.HasPrefix(pattern, "|1|") {
+			parts := strings.Split(pattern, "|")
+			if len(parts) != 4 {
+				continue
+			}
+			salt, err1 := base64.StdEncoding.DecodeString(parts[2])
+			hash, err2 := base64.StdEncoding.DecodeString(parts[3])
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			mac := hmac.New(sha1.New, salt)
+			mac.Write([]byte(host))
+			ok = hmac.Equal(mac.Sum(nil), hash)
+		} else {
+			// Only * and ? are wildcards, brackets are part of "[host]:port"
+			ok, _ = path.Match(knownHostsEscaper.Replace(pattern), host)
+		}
+
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+
+	return matched
+}
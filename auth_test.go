@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"testing"
+)
+
+// hashedHost returns host hashed the way ssh-keygen -H writes it to known_hosts.
+func hashedHost(salt, host string) string {
+	mac := hmac.New(sha1.New, []byte(salt))
+	mac.Write([]byte(host))
+
+	return "|1|" + base64.StdEncoding.EncodeToString([]byte(salt)) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestKnownHostsMatch(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		host     string
+		want     bool
+	}{
+		{patterns: []string{"github.com"}, host: "github.com", want: true},
+		{patterns: []string{"github.com"}, host: "gitlab.com", want: false},
+		{patterns: []string{"gitlab.com", "github.com"}, host: "github.com", want: true},
+		{patterns: []string{"*.example.com"}, host: "git.example.com", want: true},
+		{patterns: []string{"*.example.com"}, host: "example.com", want: false},
+		{patterns: []string{"git?.example.com"}, host: "git1.example.com", want: true},
+		{patterns: []string{"[git.example.com]:2222"}, host: "[git.example.com]:2222", want: true},
+		{patterns: []string{"[git.example.com]:2222"}, host: "git.example.com", want: false},
+		{patterns: []string{"*.example.com", "!secret.example.com"}, host: "secret.example.com", want: false},
+		{patterns: []string{"!secret.example.com", "*.example.com"}, host: "git.example.com", want: true},
+		{patterns: []string{hashedHost("salt", "github.com")}, host: "github.com", want: true},
+		{patterns: []string{hashedHost("salt", "github.com")}, host: "gitlab.com", want: false},
+		{patterns: []string{"|1|not base64|x"}, host: "github.com", want: false},
+		{patterns: []string{"|1|broken"}, host: "github.com", want: false},
+	}
+
+	for _, test := range tests {
+		if got := knownHostsMatch(test.patterns, test.host); got != test.want {
+			t.Errorf("%v matching %s: got %t, want %t", test.patterns, test.host, got, test.want)
+		}
+	}
+}
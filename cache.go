@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+var unsafePathChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// cachePath returns the directory of the repository cached for a URI.
+func cachePath(uri string) string {
+	return filepath.Join(config.CacheDir, uriDirName(uri))
+}
+
+// uriDirName returns a directory name for a URI.
+// The name is readable, the hash of the full URI keeps repositories with the same name apart.
+func uriDirName(uri string) string {
+	sum := sha256.Sum256([]byte(uri))
+	name := strings.Trim(unsafePathChars.ReplaceAllString(strings.TrimSuffix(uri, ".git"), "-"), "-.")
+	if len(name) > 64 {
+		name = name[len(name)-64:]
+	}
+
+	return name + "-" + hex.EncodeToString(sum[:6])
+}
+
+// lockFile takes an exclusive lock on path, waiting for other processes that hold it.
+// The modification time of the lock file records when a cache was last used.
+func lockFile(path string, wait bool) (func(), error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// lockCache locks the cache of a URI and returns its path.
+func lockCache(uri string) (string, func(), error) {
+	if err := os.MkdirAll(config.CacheDir, 0700); err != nil {
+		return "", nil, err
+	}
+	path := cachePath(uri)
+	unlock, err := lockFile(path+".lock", true)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to lock cache of %s: %s", uri, err)
+	}
+
+	return path, unlock, nil
+}
+
+func updateCache(uri, path string) (*git.Repository, error) {
+	repo, err := git.NewFilesystemRepository(path)
+	if err != nil {
+		return nil, err
+	}
+
+	empty, err := repo.IsEmpty()
+	if err != nil {
+		return nil, err
+	}
+	if empty {
+		err = repo.Clone(&git.CloneOptions{
+			RemoteName: "origin",
+			URL:        uri,
+		})
+		if err != nil {
+			// Don't leave a half cloned cache behind
+			os.RemoveAll(path)
+			return nil, err
+		}
+
+		return repo, nil
+	}
+
+	// Only the objects we don't have yet are fetched
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return nil, err
+	}
+	if err := remote.Connect(); err != nil {
+		return nil, err
+	}
+	defer remote.Disconnect()
+
+	err = remote.Fetch(&git.FetchOptions{})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, fmt.Errorf("Failed to fetch %s: %s", uri, err)
+	}
+
+	return repo, nil
+}
+
+// pruneCache removes cached repositories that have not been used for maxAge.
+// Caches that are in use are left alone.
+func pruneCache(maxAge time.Duration) error {
+	entries, err := ioutil.ReadDir(config.CacheDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(config.CacheDir, entry.Name())
+
+		lastUsed := entry.ModTime()
+		if info, err := os.Stat(path + ".lock"); err == nil {
+			lastUsed = info.ModTime()
+		}
+		if time.Since(lastUsed) < maxAge {
+			continue
+		}
+
+		unlock, err := lockFile(path+".lock", false)
+		if err != nil {
+			log.Printf("Skipping %s, it is in use\n", entry.Name())
+			continue
+		}
+		log.Println("Removing cache:", entry.Name())
+		err = os.RemoveAll(path)
+		os.Remove(path + ".lock")
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
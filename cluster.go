@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ClusterIdentity pins the cluster a config or target may be deployed to.
+type ClusterIdentity struct {
+	Server        string `yaml:"server,omitempty"`
+	KubeSystemUID string `yaml:"kubeSystemUID,omitempty"`
+}
+
+// verifyCluster checks that the cluster kube is connected to matches the pinned identity.
+// It has to be called before anything is created or applied.
+func verifyCluster(identity *ClusterIdentity) error {
+	if identity == nil {
+		return nil
+	}
+
+	if identity.Server != "" && normalizeServer(kube.Host()) != normalizeServer(identity.Server) {
+		return fmt.Errorf("Refusing to deploy: connected to API server %s but the config is pinned to %s", kube.Host(), identity.Server)
+	}
+
+	if identity.KubeSystemUID != "" {
+		uid, err := kube.NamespaceUID("kube-system")
+		if err != nil {
+			return fmt.Errorf("Failed to verify cluster identity: %s", err)
+		}
+		if uid != identity.KubeSystemUID {
+			return fmt.Errorf("Refusing to deploy: kube-system namespace of %s has UID %s but the config is pinned to %s", kube.Host(), uid, identity.KubeSystemUID)
+		}
+	}
+
+	return nil
+}
+
+// normalizeServer makes API server URLs comparable, https://Example.com:443/ and example.com are the same server.
+func normalizeServer(server string) string {
+	if !strings.Contains(server, "://") {
+		server = "https://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return server
+	}
+
+	host := strings.ToLower(u.Host)
+	if u.Scheme == "https" {
+		host = strings.TrimSuffix(host, ":443")
+	} else if u.Scheme == "http" {
+		host = strings.TrimSuffix(host, ":80")
+	}
+
+	return u.Scheme + "://" + host + strings.TrimSuffix(u.Path, "/")
+}
@@ -2,26 +2,201 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"html/template"
 	"io/ioutil"
+	"strings"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	Namespace     string       `yaml:"namespace,omitempty"`
-	Repositories  []Repository `yaml:"repositories"`
-	DefaultBranch string       `yaml:"defaultBranch,omitempty"`
-	KubeFolder    string       `yaml:"kubernetesFolder"`
-	BaseDir       string       `yaml:"baseDir,omitempty"`
-	UpdateRepoVar string       `yaml:"updateRepoVar,omitempty"`
-	UpdateRefVar  string       `yaml:"updateRefVar,omitempty"`
+	Namespace     string           `yaml:"namespace,omitempty"`
+	Repositories  []Repository     `yaml:"repositories"`
+	DefaultBranch string           `yaml:"defaultBranch,omitempty"`
+	KubeFolder    string           `yaml:"kubernetesFolder"`
+	BaseDir       string           `yaml:"baseDir,omitempty"`
+	CacheDir      string           `yaml:"cacheDir,omitempty"`
+	UpdateRepoVar string           `yaml:"updateRepoVar,omitempty"`
+	UpdateRefVar  string           `yaml:"updateRefVar,omitempty"`
+	Timeout       string           `yaml:"timeout,omitempty"`
+	Targets       []Target         `yaml:"targets,omitempty"`
+	Cluster       *ClusterIdentity `yaml:"cluster,omitempty"`
+	// NamespaceTemplate is applied to the deploy namespace of every target.
+	NamespaceTemplate *NamespaceTemplate `yaml:"namespaceTemplate,omitempty"`
+	// WorkspaceRetention is how long the files written in a run are kept after it ends. By default they are removed right away.
+	WorkspaceRetention string `yaml:"workspaceRetention,omitempty"`
+	// ProtectedNamespaces are patterns of namespaces that are only destroyed with -confirm.
+	ProtectedNamespaces []string `yaml:"protectedNamespaces,omitempty"`
+	// Ephemeral namespaces are removed by -gc once they expire.
+	Ephemeral []EphemeralNamespace `yaml:"ephemeral,omitempty"`
+	// Workers is how many repositories are deployed at the same time.
+	Workers int `yaml:"workers,omitempty"`
+	// Auth is how repositories are fetched, unless a repository has its own.
+	Auth *GitAuth `yaml:"auth,omitempty"`
+}
+
+// Target is a cluster and namespace to deploy to.
+// In an artifact it also holds the repositories that were deployed to it.
+type Target struct {
+	Name         string            `yaml:"name"`
+	Kubeconfig   string            `yaml:"kubeconfig,omitempty"`
+	Context      string            `yaml:"context,omitempty"`
+	Namespace    string            `yaml:"namespace,omitempty"`
+	Vars         map[string]string `yaml:"vars,omitempty"`
+	Cluster      *ClusterIdentity  `yaml:"cluster,omitempty"`
+	Repositories []Repository      `yaml:"repositories,omitempty"`
 }
 
 type Repository struct {
-	Name   string `yaml:"name,omitempty"`
-	URI    string `yaml:"uri"`
+	Name    string   `yaml:"name,omitempty"`
+	URI     string   `yaml:"uri"`
+	Commit  string   `yaml:"commit,omitempty"`
+	Timeout string   `yaml:"timeout,omitempty"`
+	Prune   bool     `yaml:"prune,omitempty"`
+	Pruned  []string `yaml:"pruned,omitempty"`
+	// Version is a constraint like "~1.4", the highest tag matching it is deployed.
+	Version string `yaml:"version,omitempty"`
+	// Tag, PreviousTag and PreviousCommit record in an artifact what Version picked.
+	Tag            string `yaml:"tag,omitempty"`
+	PreviousTag    string `yaml:"previousTag,omitempty"`
+	PreviousCommit string `yaml:"previousCommit,omitempty"`
+	// KubeFolder, Branch, Namespace and Vars override kubernetesFolder, defaultBranch,
+	// the deploy namespace and the variables of the target for this repository.
+	KubeFolder string            `yaml:"kubernetesFolder,omitempty"`
+	Branch     string            `yaml:"branch,omitempty"`
+	Namespace  string            `yaml:"namespace,omitempty"`
+	Vars       map[string]string `yaml:"vars,omitempty"`
+	// Auth overrides the global auth settings for this repository.
+	Auth *GitAuth `yaml:"auth,omitempty"`
+	// Uncommitted deploys the working tree of a local repository, with the changes that are not committed.
+	Uncommitted bool `yaml:"uncommitted,omitempty"`
+	// Dirty and ContentHash record in an artifact that uncommitted changes were deployed, and the SHA-256 of the files.
+	Dirty       bool   `yaml:"dirty,omitempty"`
+	ContentHash string `yaml:"contentHash,omitempty"`
+	// DependsOn names the repositories that have to be deployed before this one.
+	DependsOn []string `yaml:"dependsOn,omitempty"`
+	// Components are the services in a monorepo, each deployed from its own folder and recorded on its own.
+	Components []Component `yaml:"components,omitempty"`
+	// Component and Path record in an artifact which component of a repository was deployed, from which folder.
+	Component string `yaml:"component,omitempty"`
+	Path      string `yaml:"path,omitempty"`
+}
+
+// Component is a service in a folder of a repository.
+type Component struct {
+	Name string `yaml:"name"`
+	// Path is the folder with the k8s files of the component, used instead of kubernetesFolder.
+	Path string `yaml:"path"`
+	// Commit overrides the ref of the repository for this component.
 	Commit string `yaml:"commit,omitempty"`
+	// DependsOn names the repositories and components that have to be deployed before this one.
+	DependsOn []string `yaml:"dependsOn,omitempty"`
+}
+
+// expandComponents replaces every repository with components by one entry per component.
+// Dependencies on such a repository become dependencies on all its components.
+func expandComponents(repos []Repository) ([]Repository, error) {
+	components := make(map[string][]string)
+	for _, repo := range repos {
+		for _, c := range repo.Components {
+			components[repositoryName(repo)] = append(components[repositoryName(repo)], c.Name)
+		}
+	}
+	dependencies := func(deps []string) []string {
+		var expanded []string
+		for _, dep := range deps {
+			if names, ok := components[dep]; ok {
+				expanded = append(expanded, names...)
+			} else {
+				expanded = append(expanded, dep)
+			}
+		}
+		return expanded
+	}
+
+	var expanded []Repository
+	for _, repo := range repos {
+		if len(repo.Components) == 0 {
+			repo.DependsOn = dependencies(repo.DependsOn)
+			expanded = append(expanded, repo)
+			continue
+		}
+		for _, c := range repo.Components {
+			if c.Name == "" || c.Path == "" {
+				return nil, fmt.Errorf("Every component of %s needs a name and a path", repositoryName(repo))
+			}
+			component := repo
+			component.Components = nil
+			component.Component = c.Name
+			component.Path = c.Path
+			if c.Commit != "" {
+				component.Commit = c.Commit
+			}
+			component.DependsOn = dependencies(append(append([]string(nil), repo.DependsOn...), c.DependsOn...))
+			expanded = append(expanded, component)
+		}
+	}
+
+	return expanded, nil
+}
+
+// kubeFolder returns the folder the k8s files of a repository are in.
+func kubeFolder(repo Repository) string {
+	if repo.Path != "" {
+		return repo.Path
+	}
+	if repo.KubeFolder != "" {
+		return repo.KubeFolder
+	}
+
+	return config.KubeFolder
+}
+
+// repositoryBranch returns the branch a repository is deployed from when nothing else picks a ref.
+func repositoryBranch(repo Repository) string {
+	if repo.Branch != "" {
+		return repo.Branch
+	}
+
+	return config.DefaultBranch
+}
+
+// repositoryNamespace returns the namespace the objects of a repository go to if they don't name one.
+func repositoryNamespace(repo Repository) string {
+	if repo.Namespace != "" {
+		return repo.Namespace
+	}
+
+	return config.Namespace
+}
+
+// repositoryEnv returns the variables a repository is rendered with: envMap with its own variables and namespace.
+// Rendering sets TAG, so every repository gets its own copy.
+func repositoryEnv(repo Repository, envMap map[string]string) map[string]string {
+	env := make(map[string]string)
+	for key, value := range envMap {
+		env[key] = value
+	}
+	for key, value := range repo.Vars {
+		env[key] = value
+	}
+	env["NAMESPACE"] = repositoryNamespace(repo)
+
+	return env
+}
+
+// repositoryName returns the name of a component, or of a repository, or the last part of its URI if it has none.
+func repositoryName(repo Repository) string {
+	if repo.Component != "" {
+		return repo.Component
+	}
+	if repo.Name != "" {
+		return repo.Name
+	}
+	repoParts := strings.Split(repo.URI, "/")
+
+	return strings.TrimSuffix(repoParts[len(repoParts)-1], ".git")
 }
 
 func parseConfig(configFile string) (*Config, error) {
@@ -41,5 +216,18 @@ func parseConfig(configFile string) (*Config, error) {
 		return nil, err
 	}
 
+	// The labels and annotations of the namespace template are rendered for every target,
+	// with the same variables as the manifests, so they are kept as written
+	if c.NamespaceTemplate != nil {
+		raw := &Config{}
+		if err := yaml.Unmarshal(configBytes, raw); err != nil {
+			return nil, fmt.Errorf("Failed to read the namespace template, template values in the config must be quoted: %s", err)
+		}
+		if raw.NamespaceTemplate != nil {
+			c.NamespaceTemplate.Labels = raw.NamespaceTemplate.Labels
+			c.NamespaceTemplate.Annotations = raw.NamespaceTemplate.Annotations
+		}
+	}
+
 	return c, nil
 }
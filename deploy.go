@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// renderRepository clones a repository at refName and renders every k8s file in it.
+// It returns the resolved commit and the rendered manifests.
+func renderRepository(logger *log.Logger, repo Repository, refName string, envMap map[string]string) (string, []*Manifest, error) {
+	var manifests []*Manifest
+	env := repositoryEnv(repo, envMap)
+	fileFunc := func(filePath, ref string) error {
+		logger.Println(repo.URI, ref, path.Base(filePath))
+		rendered, err := renderManifests(filePath, ref, repositoryName(repo), repositoryNamespace(repo), env)
+		if err != nil {
+			return err
+		}
+		for _, m := range rendered {
+			m.URI = repo.URI
+			m.Commit = ref
+		}
+		manifests = append(manifests, rendered...)
+
+		return nil
+	}
+
+	var ref string
+	var err error
+	if dir, ok := localRepoPath(repo.URI); ok {
+		ref, err = cloneLocal(logger, repo.URI, dir, kubeFolder(repo), refName, repo.Uncommitted, fileFunc)
+	} else {
+		ref, err = cloneFiles(logger, repo.URI, kubeFolder(repo), refName, fileFunc)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	return ref, manifests, nil
+}
+
+// localRepoName is the name the local repo is recorded and labeled with, the name of the working directory.
+func localRepoName() (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Base(wd), nil
+}
+
+// renderLocal renders the k8s files in the local repo, if there is a KubeFolder.
+// The objects are labeled as belonging to the local repo, so destroy and gc find them.
+func renderLocal(envMap map[string]string) ([]*Manifest, error) {
+	if config.KubeFolder == "" || config.KubeFolder == "<no value>" {
+		return nil, nil
+	}
+
+	config.KubeFolder = strings.TrimSuffix(config.KubeFolder, "/")
+	files, err := ioutil.ReadDir(config.KubeFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	owner, err := localRepoName()
+	if err != nil {
+		return nil, err
+	}
+
+	// Record where the files come from if we are in a repo
+	var localRemote, localRef string
+	if _, err := os.Stat(".git"); err == nil {
+		localRemote, _ = getLocalRemote(".git")
+		localRef, _ = getLocalRef(".git")
+	}
+
+	var manifests []*Manifest
+	for _, f := range files {
+		log.Println("./" + config.KubeFolder + "/" + f.Name())
+		rendered, err := renderManifests(config.KubeFolder+"/"+f.Name(), "", owner, config.Namespace, envMap)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range rendered {
+			m.URI = localRemote
+			m.Commit = localRef
+		}
+		manifests = append(manifests, rendered...)
+	}
+
+	return manifests, nil
+}
+
+// deployRef clones a repository at refName, applies its k8s files and waits for the rollout.
+// Files are only applied, with the pre- and post-deploy hooks around them, if the resolved commit differs from oldRef.
+// The resolved commit is returned once anything has been applied, even when that failed,
+// together with the objects that were pruned.
+func deployRef(logger *log.Logger, repo Repository, refName, oldRef string, envMap map[string]string, timeout time.Duration) (string, []*ApplyResult, error) {
+	// Collect every object first so they can be applied in dependency order
+	ref, manifests, err := renderRepository(logger, repo, refName, envMap)
+	if err != nil {
+		return "", nil, err
+	}
+
+	pre, post, manifests, err := splitHooks(manifests)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Nothing is applied, and no hooks run, if the ref didn't change
+	var applied []*ApplyResult
+	if oldRef != ref {
+		// The deploy namespace exists already, one of the repository's own may not
+		if repo.Namespace != "" {
+			if err := ensureNamespace(repo.Namespace); err != nil {
+				return "", nil, err
+			}
+		}
+
+		// A failed pre-deploy hook stops the deploy before anything else is applied
+		hooked, err := runHooks(logger, preDeployHook, pre, timeout)
+		if err != nil {
+			return "", nil, err
+		}
+
+		applied, err = kubeApply(logger, manifests)
+		for _, result := range applied {
+			logger.Println(result)
+		}
+		if err != nil {
+			return ref, nil, err
+		}
+		applied = append(applied, hooked...)
+	}
+
+	// Wait for the workloads to become ready before the new ref can be recorded
+	if err := waitForRollout(logger, applied, timeout); err != nil {
+		return ref, nil, err
+	}
+
+	if oldRef != ref {
+		hooked, err := runHooks(logger, postDeployHook, post, timeout)
+		if err != nil {
+			return ref, nil, err
+		}
+		applied = append(applied, hooked...)
+	}
+
+	// Nothing was applied if the ref didn't change, so there is nothing to compare with
+	if !repo.Prune || oldRef == ref {
+		return ref, nil, nil
+	}
+	pruned, err := pruneRepository(repositoryName(repo), repositoryNamespace(repo), applied)
+	for _, result := range pruned {
+		logger.Println(result)
+	}
+	if err != nil {
+		return ref, pruned, err
+	}
+
+	return ref, pruned, nil
+}
+
+// rollback re-applies the previously deployed ref of a repository after a failed deploy.
+func rollback(logger *log.Logger, repo Repository, failedRef, previousRef string, envMap map[string]string, timeout time.Duration) error {
+	logger.Printf("Rolling back %s from %s to %s\n", repo.URI, failedRef, previousRef)
+
+	// An empty oldRef makes sure every file is applied again
+	_, _, err := deployRef(logger, repo, previousRef, "", envMap, timeout)
+	if err != nil {
+		return err
+	}
+	logger.Printf("Rolled back %s to %s\n", repo.URI, previousRef)
+
+	return nil
+}
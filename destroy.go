@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/pkg/runtime"
+)
+
+// createdAnnotation marks namespaces that were created by the deployer, those are deleted as a whole on destroy.
+const createdAnnotation = "k8s-deployer/created"
+
+// isProtected tells if a namespace matches one of the protected patterns in the config.
+func isProtected(namespace string) bool {
+	for _, pattern := range config.ProtectedNamespaces {
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// destroyNamespace deletes everything the deployer owns in the deploy namespace and waits until it is gone.
+// A namespace created by the deployer is deleted as a whole, otherwise only the namespaced objects carrying its labels are.
+// Objects that repos deployed to namespaces of their own are deleted too, those namespaces are shared and kept.
+func destroyNamespace(repos []Repository, timeout time.Duration) ([]*ApplyResult, error) {
+	ns := namespaceObject(config.Namespace)
+	live, err := kube.Get(ns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get namespace %s: %s", config.Namespace, err)
+	}
+
+	// Objects created by a controller go away with the controller
+	selector := fmt.Sprintf("%s=%s", namespaceLabel, labelValue(config.Namespace))
+	var objects []*runtime.Unstructured
+	switch {
+	case live == nil:
+	case live.GetAnnotations()[createdAnnotation] == "true":
+		objects = append(objects, live)
+	default:
+		objects, err = ownedObjects(config.Namespace, selector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seen := map[string]bool{config.Namespace: true}
+	for _, repo := range repos {
+		namespace := repositoryNamespace(repo)
+		if seen[namespace] {
+			continue
+		}
+		seen[namespace] = true
+		owned, err := ownedObjects(namespace, selector)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, owned...)
+	}
+
+	var deleted []*ApplyResult
+	for _, obj := range objects {
+		if err := kube.Delete(obj); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, &ApplyResult{
+			Kind:      obj.GetKind(),
+			Name:      obj.GetName(),
+			Namespace: obj.GetNamespace(),
+			Action:    "deleted",
+			Object:    obj,
+		})
+	}
+
+	return deleted, waitForDeletion(stdLogger, objects, timeout)
+}
+
+// waitForDeletion waits until none of objects exist anymore.
+func waitForDeletion(logger *log.Logger, objects []*runtime.Unstructured, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	pending := objects
+	for len(pending) > 0 {
+		var remaining []*runtime.Unstructured
+		for _, obj := range pending {
+			live, err := kube.Get(obj)
+			if err != nil {
+				return fmt.Errorf("Failed to get %s %s: %s", obj.GetKind(), obj.GetName(), err)
+			}
+			if live != nil {
+				remaining = append(remaining, obj)
+			}
+		}
+		pending = remaining
+		if len(pending) == 0 {
+			break
+		}
+
+		var names []string
+		for _, obj := range pending {
+			names = append(names, strings.ToLower(obj.GetKind())+"/"+obj.GetName())
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out after %s waiting for %s to be deleted", timeout, strings.Join(names, ", "))
+		}
+		logger.Printf("Waiting for %s to be deleted\n", strings.Join(names, ", "))
+		time.Sleep(rolloutPollInterval)
+	}
+
+	return nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/client"
+	"gopkg.in/src-d/go-git.v4/plumbing/client/common"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packp/advrefs"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	osfs "gopkg.in/src-d/go-git.v4/utils/fs/os"
+)
+
+// sparseDir holds the commits that were fetched on their own, inside the cache of a repository.
+// They are kept apart from the full clone, which takes every commit it has to come with its history.
+const sparseDir = "sparse"
+
+var fetchedMu sync.Mutex
+
+// fetched remembers the commit refs resolved to in this run, so the components of a repository share one fetch.
+var fetched = make(map[string]string)
+
+// sparseStore is the object store in sparseDir.
+type sparseStore struct {
+	*git.Repository
+	storage *filesystem.Storage
+}
+
+func openSparseStore(path string) (*sparseStore, error) {
+	storage, err := filesystem.NewStorage(osfs.New(filepath.Join(path, sparseDir)))
+	if err != nil {
+		return nil, err
+	}
+	repo, err := git.NewRepository(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sparseStore{Repository: repo, storage: storage}, nil
+}
+
+// fetch stores the pack a request returns.
+func (s *sparseStore) fetch(remote uploadPack, req *fetchRequest) error {
+	pack, err := remote.fetchPack(req)
+	if err != nil {
+		return err
+	}
+	defer pack.Close()
+
+	w, err := s.storage.PackfileWriter()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, pack); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// connectRemote connects to the upload-pack service of a URI.
+func connectRemote(uri string) (uploadPack, error) {
+	endpoint, err := common.NewEndpoint(uri)
+	if err != nil {
+		return nil, err
+	}
+	service, err := clients.NewGitUploadPackService(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	remote, ok := service.(uploadPack)
+	if !ok {
+		return nil, fmt.Errorf("Fetching single commits over %s is not supported", endpoint.Scheme)
+	}
+	if err := remote.Connect(); err != nil {
+		return nil, err
+	}
+
+	return remote, nil
+}
+
+// fetchCommit returns the commit refName points to and the repository in the cache at path holding it.
+// Only that commit is fetched, without its history and, if the server can filter, without its files.
+// Abbreviated hashes, and commits the server refuses to send on their own, are fetched with the full history.
+func fetchCommit(uri, path, refName string) (*git.Repository, *git.Commit, error) {
+	full, err := git.NewFilesystemRepository(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	sparse, err := openSparseStore(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fullHash := len(refName) == 40 && hexRef.MatchString(refName)
+	if !fullHash && hexRef.MatchString(refName) {
+		return fetchFull(uri, path, refName)
+	}
+	// A commit we already have needs no fetch at all
+	if fullHash {
+		if repo, commit := findCommit(plumbing.NewHash(refName), sparse.Repository, full); commit != nil {
+			return repo, commit, nil
+		}
+	}
+
+	remote, err := connectRemote(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer remote.Disconnect()
+
+	ar, err := remote.advertisedRefs()
+	if err != nil {
+		return nil, nil, err
+	}
+	want, err := advertisedRef(ar, refName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if repo, commit := findCommit(want, sparse.Repository, full); commit != nil {
+		return repo, commit, nil
+	}
+
+	req := &fetchRequest{wants: []plumbing.Hash{want}}
+	if ar.Capabilities.Supports("shallow") {
+		req.depth = 1
+	}
+	if ar.Capabilities.Supports("filter") {
+		req.filter = "blob:none"
+	}
+	if err := sparse.fetch(remote, req); err != nil {
+		// Servers only send commits that are not a branch or tag if they are configured to
+		return fetchFull(uri, path, refName)
+	}
+	commit, err := peelCommit(sparse.Repository, want)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sparse.Repository, commit, nil
+}
+
+// fetchFull updates the full clone in the cache and resolves refName in it.
+func fetchFull(uri, path, refName string) (*git.Repository, *git.Commit, error) {
+	repo, err := updateCache(uri, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	commit, err := resolveCommit(repo, path, refName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return repo, commit, nil
+}
+
+func findCommit(h plumbing.Hash, repos ...*git.Repository) (*git.Repository, *git.Commit) {
+	for _, repo := range repos {
+		if commit, err := peelCommit(repo, h); err == nil {
+			return repo, commit
+		}
+	}
+
+	return nil, nil
+}
+
+// advertisedRef looks up refName in the refs a server advertises and returns the object to fetch for it.
+// Tags and branches are looked up like resolveCommit does in the cache.
+func advertisedRef(ar *advrefs.AdvRefs, refName string) (plumbing.Hash, error) {
+	if len(refName) == 40 && hexRef.MatchString(refName) {
+		return plumbing.NewHash(refName), nil
+	}
+
+	var names []string
+	switch {
+	case strings.HasPrefix(refName, "refs/remotes/origin/"):
+		names = []string{"refs/heads/" + strings.TrimPrefix(refName, "refs/remotes/origin/")}
+	case strings.HasPrefix(refName, "refs/"):
+		names = []string{refName}
+	default:
+		names = []string{"refs/tags/" + refName, "refs/heads/" + refName}
+		if strings.HasPrefix(refName, "origin/") {
+			names = append(names, "refs/heads/"+strings.TrimPrefix(refName, "origin/"))
+		}
+	}
+
+	var want plumbing.Hash
+	candidates := make(map[plumbing.Hash][]string)
+	for _, name := range names {
+		h, ok := ar.References[name]
+		if !ok {
+			continue
+		}
+		commit := h
+		if peeled, ok := ar.Peeled[name]; ok {
+			commit = peeled
+		}
+		candidates[commit] = append(candidates[commit], name)
+		want = h
+	}
+	if _, err := singleCandidate(refName, candidates); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return want, nil
+}
+
+// kubeFile is a file in the Kubernetes folder of a commit.
+type kubeFile struct {
+	name string
+	mode os.FileMode
+	hash plumbing.Hash
+}
+
+// kubeFiles lists the files under folder in a commit, reading only the trees on the way there.
+func kubeFiles(repo *git.Repository, commit *git.Commit, folder string) ([]kubeFile, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := strings.Trim(folder, "/")
+	if dir != "" {
+		for _, part := range strings.Split(dir, "/") {
+			var next *git.Tree
+			for _, entry := range tree.Entries {
+				if entry.Name == part && entry.Mode&os.ModeDir != 0 {
+					if next, err = repo.Tree(entry.Hash); err != nil {
+						return nil, err
+					}
+					break
+				}
+			}
+			if next == nil {
+				// A repository without a Kubernetes folder has nothing to deploy
+				return nil, nil
+			}
+			tree = next
+		}
+	}
+
+	return treeFiles(repo, tree, dir)
+}
+
+func treeFiles(repo *git.Repository, tree *git.Tree, dir string) ([]kubeFile, error) {
+	var files []kubeFile
+	for _, entry := range tree.Entries {
+		name := entry.Name
+		if dir != "" {
+			name = dir + "/" + entry.Name
+		}
+		switch {
+		case entry.Mode&os.ModeDir != 0:
+			sub, err := repo.Tree(entry.Hash)
+			if err != nil {
+				return nil, err
+			}
+			subFiles, err := treeFiles(repo, sub, name)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, subFiles...)
+		case entry.Mode&0170000 == 0100000:
+			// Symlinks and submodules are left out
+			files = append(files, kubeFile{name: name, mode: entry.Mode.Perm(), hash: entry.Hash})
+		}
+	}
+
+	return files, nil
+}
+
+// fetchBlobs fetches the files of a commit that were filtered out when it was fetched,
+// and returns the repository to read them from.
+// If the server does not send them on their own the commit is fetched again with all its files.
+func fetchBlobs(uri, path string, repo *git.Repository, commit *git.Commit, files []kubeFile) (*git.Repository, error) {
+	var missing []plumbing.Hash
+	for _, f := range files {
+		if _, err := repo.Blob(f.hash); err != nil {
+			missing = append(missing, f.hash)
+		}
+	}
+	if len(missing) == 0 {
+		return repo, nil
+	}
+
+	sparse, err := openSparseStore(path)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := connectRemote(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Disconnect()
+
+	if err := sparse.fetch(remote, &fetchRequest{wants: missing}); err != nil {
+		if err := sparse.fetch(remote, &fetchRequest{wants: []plumbing.Hash{commit.Hash}, depth: 1}); err != nil {
+			return nil, err
+		}
+	}
+
+	return sparse.Repository, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packp/advrefs"
+)
+
+func TestAdvertisedRef(t *testing.T) {
+	commit := plumbing.NewHash("1111111111111111111111111111111111111111")
+	tag := plumbing.NewHash("2222222222222222222222222222222222222222")
+	other := plumbing.NewHash("3333333333333333333333333333333333333333")
+
+	ar := advrefs.New()
+	ar.References["refs/heads/master"] = commit
+	ar.References["refs/heads/release"] = other
+	// An annotated tag is advertised with the commit it points to
+	ar.References["refs/tags/v1.0.0"] = tag
+	ar.Peeled["refs/tags/v1.0.0"] = commit
+	// A tag and a branch with the same name on different commits
+	ar.References["refs/tags/stable"] = commit
+	ar.References["refs/heads/stable"] = other
+	// A tag and a branch with the same name on the same commit
+	ar.References["refs/tags/same"] = other
+	ar.References["refs/heads/same"] = other
+
+	tests := []struct {
+		ref     string
+		want    plumbing.Hash
+		invalid bool
+	}{
+		{ref: "master", want: commit},
+		{ref: "origin/master", want: commit},
+		{ref: "refs/remotes/origin/release", want: other},
+		{ref: "refs/heads/release", want: other},
+		{ref: "v1.0.0", want: tag},
+		{ref: "refs/tags/stable", want: commit},
+		{ref: "same", want: other},
+		{ref: other.String(), want: other},
+		{ref: "stable", invalid: true},
+		{ref: "missing", invalid: true},
+		{ref: "refs/heads/v1.0.0", invalid: true},
+	}
+
+	for _, test := range tests {
+		got, err := advertisedRef(ar, test.ref)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.ref, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.ref, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.ref, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// Annotations stamped on the deploy namespace on every deploy.
+const (
+	lastDeployedAnnotation = "k8s-deployer/last-deployed"
+	branchAnnotation       = "k8s-deployer/branch"
+)
+
+// EphemeralNamespace marks namespaces matching Pattern as short lived, they are removed by -gc.
+type EphemeralNamespace struct {
+	Pattern string `yaml:"pattern"`
+	// TTL is how long after the last deploy the namespace is removed.
+	TTL string `yaml:"ttl,omitempty"`
+	// BranchVar is the environment variable holding the branch the namespace is deployed from.
+	// The namespace is removed once that branch is gone from the remote of the local repo.
+	BranchVar string `yaml:"branchVar,omitempty"`
+}
+
+// ephemeralRule returns the first ephemeral rule matching namespace, or nil.
+func ephemeralRule(namespace string) *EphemeralNamespace {
+	for i, rule := range config.Ephemeral {
+		if matched, _ := path.Match(rule.Pattern, namespace); matched {
+			return &config.Ephemeral[i]
+		}
+	}
+
+	return nil
+}
+
+// stampNamespace records when the deploy namespace was last deployed to, and from which branch.
+func stampNamespace(envMap map[string]string) error {
+	annotations := map[string]string{
+		lastDeployedAnnotation: time.Now().UTC().Format(time.RFC3339),
+	}
+	if rule := ephemeralRule(config.Namespace); rule != nil && rule.BranchVar != "" && envMap[rule.BranchVar] != "" {
+		annotations[branchAnnotation] = envMap[rule.BranchVar]
+	}
+
+	// Applying would replace the last applied configuration of the namespace template
+	return kube.Annotate(namespaceObject(config.Namespace), annotations)
+}
+
+// collectGarbage destroys the ephemeral namespaces that are past their TTL or whose branch is gone,
+// together with what repos deployed for them to namespaces of their own.
+func collectGarbage(repos []Repository, timeout time.Duration) error {
+	namespaces, err := kube.Namespaces()
+	if err != nil {
+		return err
+	}
+
+	// Branches are only checked when we are in a repo
+	var branches map[string]bool
+	if _, err := os.Stat(".git"); err == nil {
+		branches, err = getRemoteBranches(".git")
+		if err != nil {
+			return fmt.Errorf("Failed to list remote branches: %s", err)
+		}
+	}
+
+	now := time.Now()
+	for _, ns := range namespaces {
+		rule := ephemeralRule(ns.Name)
+		if rule == nil {
+			continue
+		}
+		if isProtected(ns.Name) {
+			log.Printf("Skipping protected namespace %s\n", ns.Name)
+			continue
+		}
+
+		reason := ""
+		if branch := ns.Annotations[branchAnnotation]; branch != "" && branches != nil && !branches[branch] {
+			reason = fmt.Sprintf("branch %s no longer exists", branch)
+		}
+		if reason == "" && rule.TTL != "" {
+			ttl, err := time.ParseDuration(rule.TTL)
+			if err != nil {
+				return fmt.Errorf("Invalid ttl for %s: %s", rule.Pattern, err)
+			}
+			lastDeployed := ns.CreationTimestamp.Time
+			if stamp, err := time.Parse(time.RFC3339, ns.Annotations[lastDeployedAnnotation]); err == nil {
+				lastDeployed = stamp
+			}
+			if age := now.Sub(lastDeployed); age > ttl {
+				reason = fmt.Sprintf("last deployed %s ago", age-age%time.Second)
+			}
+		}
+		if reason == "" {
+			continue
+		}
+
+		log.Printf("Destroying namespace %s: %s\n", ns.Name, reason)
+		config.Namespace = ns.Name
+		deleted, err := destroyNamespace(repos, timeout)
+		for _, result := range deleted {
+			log.Println(result)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to destroy namespace %s: %s", ns.Name, err)
+		}
+		if state != nil {
+			if err := state.Clear(statePrefix(currentTarget, ns.Name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -3,13 +3,13 @@ package main
 import (
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 
 	git "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
-	"gopkg.in/src-d/go-git.v4/plumbing/client/ssh"
 )
 
 func getLocalRef(path string) (string, error) {
@@ -40,110 +40,111 @@ func getLocalRemote(path string) (string, error) {
 	return remote.Config().URL, nil
 }
 
-func cloneFiles(repoURI string, refName string, fileFunc func(string, string) error) (string, error) {
-	repoParts := strings.Split(repoURI, "/")
-	repoName := strings.TrimSuffix(repoParts[len(repoParts)-1], ".git")
-	repoPath := config.BaseDir + repoName
-
-	os.RemoveAll(repoPath)
+// getRemoteBranches returns the names of the branches on the origin remote of a local repo.
+func getRemoteBranches(path string) (map[string]bool, error) {
+	repo, err := git.NewFilesystemRepository(path)
+	if err != nil {
+		return nil, err
+	}
 
-	repo, err := git.NewFilesystemRepository(repoPath + "/.git")
+	remote, err := repo.Remote("origin")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	auth, err := ssh.NewSSHAgentAuth("git")
+	if err := remote.Connect(); err != nil {
+		return nil, err
+	}
+	defer remote.Disconnect()
+
+	refs, err := remote.Refs()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	defer refs.Close()
 
-	fmt.Println(repoURI, refName)
+	branches := make(map[string]bool)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.IsBranch() {
+			branches[strings.TrimPrefix(ref.Name().String(), "refs/heads/")] = true
+		}
 
-	err = repo.Clone(&git.CloneOptions{
-		Auth:       auth,
-		RemoteName: "origin",
-		URL:        repoURI,
+		return nil
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	iter, err := repo.Commits()
+	return branches, nil
+}
+
+func cloneFiles(logger *log.Logger, repoURI, folder, refName string, fileFunc func(string, string) error) (string, error) {
+	logger.Println(repoURI, refName)
+
+	path, unlock, err := lockCache(repoURI)
 	if err != nil {
 		return "", err
 	}
-	defer iter.Close()
-
-	var commit *git.Commit
-	if strings.HasPrefix(refName, "refs/") {
-		ref, err := repo.Ref(plumbing.ReferenceName(refName), false)
-		if err != nil {
-			return "", err
-		}
-		commit, err = repo.Commit(ref.Hash())
-		if err != nil {
-			return "", err
-		}
-	} else {
-		iter.ForEach(func(c *git.Commit) error {
-			if c.Hash.String() == refName {
-				commit = c
-				iter.Close()
-			}
-
-			return nil
-		})
+	defer unlock()
+
+	// A ref that was fetched before in this run is not looked up again
+	fetchedMu.Lock()
+	wanted, ok := fetched[repoURI+" "+refName]
+	fetchedMu.Unlock()
+	if !ok {
+		wanted = refName
 	}
-	if commit == nil {
-		return "", fmt.Errorf("Could not find commit")
+	repo, commit, err := fetchCommit(repoURI, path, wanted)
+	if err != nil {
+		return "", err
 	}
+	fetchedMu.Lock()
+	fetched[repoURI+" "+refName] = commit.Hash.String()
+	fetchedMu.Unlock()
 
-	files, err := commit.Files()
+	files, err := kubeFiles(repo, commit, folder)
+	if err != nil {
+		return "", err
+	}
+	repo, err = fetchBlobs(repoURI, path, repo, commit, files)
 	if err != nil {
 		return "", err
 	}
 
-	err = files.ForEach(func(f *git.File) error {
-		if strings.HasPrefix(f.Name, config.KubeFolder) {
-			abs := filepath.Join(repoPath, f.Name)
-			dir := filepath.Dir(abs)
-
-			os.MkdirAll(dir, 0777)
-			file, err := os.Create(abs)
-			if err != nil {
-				return err
-			}
-
-			defer file.Close()
-			r, err := f.Reader()
-			if err != nil {
-				return err
-			}
-
-			defer r.Close()
-
-			if err := file.Chmod(f.Mode); err != nil {
-				return err
-			}
+	// Every run writes the files to its own workspace, removed when it ends
+	repoPath := repoWorkspace(repoURI, commit.Hash.String())
 
-			_, err = io.Copy(file, r)
-			if err != nil {
-				return err
-			}
+	for _, f := range files {
+		abs := filepath.Join(repoPath, f.name)
+		if err := writeBlob(repo, f, abs); err != nil {
+			return "", err
+		}
+		if err := fileFunc(repoPath+"/"+f.name, commit.Hash.String()); err != nil {
+			return "", err
+		}
+	}
 
-			err = fileFunc(repoPath+"/"+f.Name, commit.Hash.String())
-			if err != nil {
-				return err
-			}
+	return commit.Hash.String(), nil
+}
 
-			return err
-		}
+func writeBlob(repo *git.Repository, f kubeFile, path string) error {
+	blob, err := repo.Blob(f.hash)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %s", f.name, err)
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
 
-		return nil
-	})
+	os.MkdirAll(filepath.Dir(path), 0777)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.mode)
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer file.Close()
 
-	return commit.Hash.String(), nil
+	_, err = io.Copy(file, r)
 
+	return err
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dependencyIndex maps the names repositories are depended on by to their position in repos.
+// Names given as name or component must be unique. Names taken from the URI can be shared,
+// like by repositories of different groups, as long as nothing depends on them.
+func dependencyIndex(repos []Repository) (map[string]int, error) {
+	index := make(map[string]int)
+	explicit := make(map[string]bool)
+	ambiguous := make(map[string]bool)
+	for i, repo := range repos {
+		name := repositoryName(repo)
+		named := repo.Name != "" || repo.Component != ""
+		if _, found := index[name]; found {
+			if named && explicit[name] {
+				return nil, fmt.Errorf("Repository %s is listed more than once", name)
+			}
+			ambiguous[name] = true
+		}
+		if named {
+			explicit[name] = true
+		}
+		index[name] = i
+	}
+	for _, repo := range repos {
+		for _, dep := range repo.DependsOn {
+			if ambiguous[dep] {
+				return nil, fmt.Errorf("Repository %s depends on %s, which is the name of more than one repository", repositoryName(repo), dep)
+			}
+			if _, found := index[dep]; !found {
+				return nil, fmt.Errorf("Repository %s depends on unknown repository %s", repositoryName(repo), dep)
+			}
+		}
+	}
+
+	return index, nil
+}
+
+// checkDependencies makes sure every dependsOn names a single repository in repos and that there are no cycles.
+// It returns the index of the names from dependencyIndex, to schedule the repositories with.
+func checkDependencies(repos []Repository) (map[string]int, error) {
+	index, err := dependencyIndex(repos)
+	if err != nil {
+		return nil, err
+	}
+
+	// Depth first search, a repository that is reached again while it is being visited is part of a cycle
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make([]int, len(repos))
+	var path []string
+	var visit func(i int) error
+	visit = func(i int) error {
+		name := repositoryName(repos[i])
+		switch marks[i] {
+		case visiting:
+			return fmt.Errorf("Dependency cycle: %s -> %s", strings.Join(path, " -> "), name)
+		case visited:
+			return nil
+		}
+
+		marks[i] = visiting
+		path = append(path, name)
+		for _, dep := range repos[i].DependsOn {
+			if err := visit(index[dep]); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[i] = visited
+
+		return nil
+	}
+	for i := range repos {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return index, nil
+}
+
+// runGraph calls run for every repository, with at most workers running at the same time.
+// A repository only starts once all repositories it depends on have finished without error.
+// After the first error no new repositories are started, the ones running are waited for.
+func runGraph(repos []Repository, workers int, run func(i int) error) error {
+	index, err := checkDependencies(repos)
+	if err != nil {
+		return err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	waiting := make([]int, len(repos))
+	dependents := make([][]int, len(repos))
+	var ready []int
+	for i, repo := range repos {
+		waiting[i] = len(repo.DependsOn)
+		for _, dep := range repo.DependsOn {
+			dependents[index[dep]] = append(dependents[index[dep]], i)
+		}
+		if waiting[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	type result struct {
+		index int
+		err   error
+	}
+	done := make(chan result)
+	running := 0
+	var failed error
+	for {
+		for failed == nil && running < workers && len(ready) > 0 {
+			i := ready[0]
+			ready = ready[1:]
+			running++
+			go func() {
+				done <- result{i, run(i)}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+
+		r := <-done
+		running--
+		if r.err != nil {
+			if failed == nil {
+				failed = r.err
+			}
+			continue
+		}
+		for _, dependent := range dependents[r.index] {
+			waiting[dependent]--
+			if waiting[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	return failed
+}
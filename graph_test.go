@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckDependencies(t *testing.T) {
+	tests := []struct {
+		name  string
+		repos []Repository
+		err   string
+	}{
+		{
+			name: "no dependencies",
+			repos: []Repository{
+				{URI: "git@example.com:group/api.git"},
+				{URI: "git@example.com:group/web.git"},
+			},
+		},
+		{
+			name: "dependency on a name",
+			repos: []Repository{
+				{URI: "git@example.com:group/db.git", Name: "database"},
+				{URI: "git@example.com:group/api.git", DependsOn: []string{"database"}},
+			},
+		},
+		{
+			name: "same URI name in different groups",
+			repos: []Repository{
+				{URI: "git@example.com:one/api.git"},
+				{URI: "git@example.com:two/api.git"},
+			},
+		},
+		{
+			name: "dependency on a shared URI name",
+			repos: []Repository{
+				{URI: "git@example.com:one/api.git"},
+				{URI: "git@example.com:two/api.git"},
+				{URI: "git@example.com:one/web.git", DependsOn: []string{"api"}},
+			},
+			err: "Repository web depends on api, which is the name of more than one repository",
+		},
+		{
+			name: "name shared with a URI name",
+			repos: []Repository{
+				{URI: "git@example.com:one/api.git"},
+				{URI: "git@example.com:two/gateway.git", Name: "api"},
+			},
+		},
+		{
+			name: "duplicate names",
+			repos: []Repository{
+				{URI: "git@example.com:one/api.git", Name: "api"},
+				{URI: "git@example.com:two/api.git", Name: "api"},
+			},
+			err: "Repository api is listed more than once",
+		},
+		{
+			name: "duplicate components",
+			repos: []Repository{
+				{URI: "git@example.com:one/mono.git", Component: "worker"},
+				{URI: "git@example.com:two/mono.git", Component: "worker"},
+			},
+			err: "Repository worker is listed more than once",
+		},
+		{
+			name: "unknown dependency",
+			repos: []Repository{
+				{URI: "git@example.com:group/api.git", DependsOn: []string{"database"}},
+			},
+			err: "Repository api depends on unknown repository database",
+		},
+		{
+			name: "cycle",
+			repos: []Repository{
+				{URI: "git@example.com:group/a.git", DependsOn: []string{"c"}},
+				{URI: "git@example.com:group/b.git", DependsOn: []string{"a"}},
+				{URI: "git@example.com:group/c.git", DependsOn: []string{"b"}},
+			},
+			err: "Dependency cycle: a -> c -> b -> a",
+		},
+		{
+			name: "depends on itself",
+			repos: []Repository{
+				{URI: "git@example.com:group/a.git", DependsOn: []string{"a"}},
+			},
+			err: "Dependency cycle: a -> a",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := checkDependencies(test.repos)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
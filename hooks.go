@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/pkg/runtime"
+)
+
+// hookAnnotation marks a manifest as a hook that runs before or after the rest of its repository is applied.
+const hookAnnotation = "k8s-deployer/hook"
+
+// Hook phases, in the order they run.
+const (
+	preDeployHook  = "pre-deploy"
+	postDeployHook = "post-deploy"
+)
+
+// splitHooks separates the pre- and post-deploy hooks from the other manifests.
+func splitHooks(manifests []*Manifest) (pre, post, rest []*Manifest, err error) {
+	for _, m := range manifests {
+		switch phase := m.Object.GetAnnotations()[hookAnnotation]; phase {
+		case "":
+			rest = append(rest, m)
+		case preDeployHook:
+			pre = append(pre, m)
+		case postDeployHook:
+			post = append(post, m)
+		default:
+			return nil, nil, nil, fmt.Errorf("%s: Unknown hook %s, expected %s or %s", m, phase, preDeployHook, postDeployHook)
+		}
+	}
+
+	return pre, post, rest, nil
+}
+
+// runHooks applies the hooks of a phase and waits for their Jobs to complete.
+// Hooks left from an earlier deploy are deleted first, since a Job can't be changed once it has run.
+// The logs of every hook Job are written to the log, whether it succeeded or not.
+func runHooks(logger *log.Logger, phase string, hooks []*Manifest, timeout time.Duration) ([]*ApplyResult, error) {
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+	logger.Printf("Running %s hooks\n", phase)
+
+	for _, m := range hooks {
+		live, err := kube.Get(m.Object)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", m, err)
+		}
+		if live == nil {
+			continue
+		}
+		if err := kube.Delete(live); err != nil {
+			return nil, fmt.Errorf("%s: %s", m, err)
+		}
+		if err := waitForDeletion(logger, []*runtime.Unstructured{live}, timeout); err != nil {
+			return nil, fmt.Errorf("%s: %s", m, err)
+		}
+	}
+
+	applied, err := kubeApply(logger, hooks)
+	for _, result := range applied {
+		logger.Println(result)
+	}
+	if err != nil {
+		return applied, fmt.Errorf("%s hook failed: %s", phase, err)
+	}
+
+	err = waitForRollout(logger, applied, timeout)
+	for _, result := range applied {
+		if result.Kind != "Job" {
+			continue
+		}
+		logs, logErr := kube.JobLogs(result.Object)
+		if logErr != nil {
+			logger.Printf("Failed to get logs of job/%s: %s\n", result.Name, logErr)
+			continue
+		}
+		for pod, output := range logs {
+			logger.Printf("Logs of pod/%s (job/%s):\n%s", pod, result.Name, indentLines(output))
+		}
+	}
+	if err != nil {
+		return applied, fmt.Errorf("%s hook failed: %s", phase, err)
+	}
+
+	return applied, nil
+}
+
+// indentLines indents every line of s so it stands out in the log.
+func indentLines(s string) string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return ""
+	}
+
+	return "    " + strings.Replace(s, "\n", "\n    ", -1) + "\n"
+}
@@ -1,93 +1,495 @@
 package main
 
 import (
-	"bytes"
+	"encoding/json"
 	"fmt"
-	"html/template"
-	"io/ioutil"
 	"log"
-	"os"
-	"os/exec"
 	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api"
+	"k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/unversioned"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/runtime"
+	"k8s.io/client-go/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Labels put on every object applied from a repository, used to find the objects it owns.
+const (
+	repositoryLabel = "k8s-deployer/repository"
+	namespaceLabel  = "k8s-deployer/namespace"
 )
 
-func namespaceExists(namespace string) bool {
-	cmd := exec.Command("kubectl", "get", "namespace", namespace)
-	err := cmd.Run()
-	if err == nil {
-		return true
+// KubeClient talks directly to the Kubernetes API server.
+type KubeClient struct {
+	clientset *kubernetes.Clientset
+	client    *rest.RESTClient
+	discovery *discovery.DiscoveryClient
+	// mu guards resources, repositories can be deployed concurrently.
+	mu        sync.Mutex
+	resources map[string]*unversioned.APIResourceList
+	host      string
+}
+
+// ApplyResult describes what happened to a single object when it was applied.
+type ApplyResult struct {
+	Kind      string
+	Name      string
+	Namespace string
+	Action    string
+	Object    *runtime.Unstructured
+}
+
+func (r *ApplyResult) String() string {
+	if r.Namespace != "" {
+		return fmt.Sprintf("%s/%s %s (namespace %s)", strings.ToLower(r.Kind), r.Name, r.Action, r.Namespace)
 	}
 
-	return false
+	return fmt.Sprintf("%s/%s %s", strings.ToLower(r.Kind), r.Name, r.Action)
 }
 
-func kubeCreateNamespace(namespace string) error {
-	cmd := exec.Command("kubectl", "create", "namespace", namespace)
-	cmd.Env = os.Environ()
-	var out bytes.Buffer
-	var errBuf bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &errBuf
-	err := cmd.Run()
-	log.Println(strings.Trim(out.String(), "\r\n"))
+// NewKubeClient loads the kubeconfig the same way kubectl does.
+// If kubeconfig is empty the default loading rules ($KUBECONFIG, ~/.kube/config) apply,
+// and if context is empty the current context is used.
+func NewKubeClient(kubeconfig, context string) (*KubeClient, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	overrides := &clientcmd.ConfigOverrides{
+		CurrentContext: context,
+	}
+
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
 	if err != nil {
-		log.Printf("Command 'kubectl create namespace %s' returned with non-zero code: %s\n", namespace, err.Error())
-		log.Println(strings.Trim(errBuf.String(), "\r\n"))
+		return nil, fmt.Errorf("Failed to load kubeconfig: %s", err)
+	}
 
-		return err
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// The generic client only ever uses absolute paths, the group version is just needed to construct it.
+	genericConfig := *restConfig
+	genericConfig.APIPath = "/api"
+	genericConfig.GroupVersion = &schema.GroupVersion{Version: "v1"}
+	genericConfig.NegotiatedSerializer = api.Codecs
+	client, err := rest.RESTClientFor(&genericConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KubeClient{
+		clientset: clientset,
+		client:    client,
+		discovery: discoveryClient,
+		resources: make(map[string]*unversioned.APIResourceList),
+		host:      restConfig.Host,
+	}, nil
 }
 
-func kubeApply(kubefile, tag string, env map[string]string) error {
-	configBytes, err := ioutil.ReadFile(kubefile)
+// Host returns the address of the API server the client talks to.
+func (k *KubeClient) Host() string {
+	return k.host
+}
+
+func (k *KubeClient) NamespaceExists(namespace string) (bool, error) {
+	_, err := k.clientset.Core().Namespaces().Get(namespace)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
 	if err != nil {
-		return fmt.Errorf("Failed to read file %s: %s", kubefile, err)
+		return false, err
 	}
 
-	funcMap := template.FuncMap{
-		"ToUpper": strings.ToUpper,
-		"ToLower": strings.ToLower,
-		"Title":   strings.Title,
-		"TrimPrefix": func(t, s string) string {
-			return strings.TrimPrefix(s, t)
-		},
-		"TrimSuffix": func(t, s string) string {
-			return strings.TrimSuffix(s, t)
-		},
-		"Replace": func(f, t, s string) string {
-			return strings.Replace(s, f, t, 1000)
+	return true, nil
+}
+
+// NamespaceUID returns the UID of a namespace, which identifies the cluster it lives in.
+func (k *KubeClient) NamespaceUID(namespace string) (string, error) {
+	ns, err := k.clientset.Core().Namespaces().Get(namespace)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get namespace %s: %s", namespace, err)
+	}
+
+	return string(ns.UID), nil
+}
+
+// Namespaces lists every namespace in the cluster.
+func (k *KubeClient) Namespaces() ([]v1.Namespace, error) {
+	list, err := k.clientset.Core().Namespaces().List(v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list namespaces: %s", err)
+	}
+
+	return list.Items, nil
+}
+
+func (k *KubeClient) CreateNamespace(namespace string) error {
+	_, err := k.clientset.Core().Namespaces().Create(&v1.Namespace{
+		ObjectMeta: v1.ObjectMeta{
+			Name: namespace,
+			Annotations: map[string]string{
+				createdAnnotation: "true",
+			},
 		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create namespace %s: %s", namespace, err)
+	}
+
+	return nil
+}
+
+// mapping finds the resource name for an object and whether it lives in a namespace.
+func (k *KubeClient) mapping(obj *runtime.Unstructured) (*unversioned.APIResource, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	gv := obj.GetAPIVersion()
+	if resource := findResource(k.resources[gv], obj.GetKind()); resource != nil {
+		return resource, nil
 	}
 
-	tmpl, err := template.New("config").Funcs(funcMap).Parse(string(configBytes))
+	// Not cached, or the kind was added since the last lookup, for example by a CRD
+	list, err := k.discovery.ServerResourcesForGroupVersion(gv)
 	if err != nil {
-		return fmt.Errorf("Failed to create template: %s", err)
+		return nil, fmt.Errorf("Failed to discover resources for %s: %s", gv, err)
+	}
+	k.resources[gv] = list
+
+	if resource := findResource(list, obj.GetKind()); resource != nil {
+		return resource, nil
+	}
+
+	return nil, fmt.Errorf("No resource found for kind %s in %s", obj.GetKind(), gv)
+}
+
+func findResource(list *unversioned.APIResourceList, kind string) *unversioned.APIResource {
+	if list == nil {
+		return nil
+	}
+	for i, r := range list.APIResources {
+		// Skip subresources like deployments/scale
+		if strings.Contains(r.Name, "/") {
+			continue
+		}
+		if r.Kind == kind {
+			return &list.APIResources[i]
+		}
+	}
+
+	return nil
+}
+
+// resourcePath builds the path segments for an object's collection.
+func (k *KubeClient) resourcePath(obj *runtime.Unstructured) ([]string, error) {
+	resource, err := k.mapping(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := groupVersionPath(obj.GetAPIVersion())
+	if resource.Namespaced {
+		segments = append(segments, "namespaces", obj.GetNamespace())
+	}
+
+	return append(segments, resource.Name), nil
+}
+
+// groupVersionPath returns the path segments of an API group version.
+// The core group lives under /api, all others under /apis.
+func groupVersionPath(groupVersion string) []string {
+	if strings.Contains(groupVersion, "/") {
+		return []string{"/apis", groupVersion}
 	}
-	out, err := ioutil.TempFile(config.BaseDir, tag)
+
+	return []string{"/api", groupVersion}
+}
+
+// Get fetches the live version of obj. It returns nil without error if the object does not exist.
+func (k *KubeClient) Get(obj *runtime.Unstructured) (*runtime.Unstructured, error) {
+	segments, err := k.resourcePath(obj)
 	if err != nil {
-		return fmt.Errorf("Failed to create temp file: %s", err)
+		return nil, err
+	}
+
+	res := k.client.Get().AbsPath(append(segments, obj.GetName())...).Do()
+	if err := res.Error(); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
 	}
-	env["TAG"] = tag
-	err = tmpl.Execute(out, env)
+
+	return decodeResult(res)
+}
+
+// Apply creates obj if it does not exist, otherwise it patches the live object to match it.
+// The patch is computed from obj, the live object and the configuration it was last applied with.
+func (k *KubeClient) Apply(obj *runtime.Unstructured) (*ApplyResult, error) {
+	result := &ApplyResult{
+		Kind:      obj.GetKind(),
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+		Object:    obj,
+	}
+
+	resource, err := k.mapping(obj)
 	if err != nil {
-		return fmt.Errorf("Failed to render template: %s", err)
+		return nil, err
 	}
-	out.Close()
-	cmd := exec.Command("kubectl", "-n", config.Namespace, "apply", "-f", out.Name())
-	cmd.Env = os.Environ()
-	var cmdOut bytes.Buffer
-	var errBuf bytes.Buffer
-	cmd.Stdout = &cmdOut
-	cmd.Stderr = &errBuf
-	err = cmd.Run()
-	log.Println(strings.Trim(cmdOut.String(), "\r\n"))
+	// Only send the namespace for resources that actually have one
+	if !resource.Namespaced {
+		obj.SetNamespace("")
+		result.Namespace = ""
+	}
+	segments, err := k.resourcePath(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like kubectl apply, remember what was applied so fields removed from the manifest are removed later on
+	if err := setLastApplied(obj); err != nil {
+		return nil, err
+	}
+	body, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	live, err := k.Get(obj)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get %s %s: %s", result.Kind, result.Name, err)
+	}
+
+	if live == nil {
+		err = k.client.Post().AbsPath(segments...).Body(body).Do().Error()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create %s %s: %s", result.Kind, result.Name, err)
+		}
+		result.Action = "created"
+
+		return result, nil
+	}
+
+	patch, err := applyPatch(obj, live)
+	if err != nil {
+		return nil, err
+	}
+	if len(patch) == 0 {
+		result.Action = "unchanged"
+
+		return result, nil
+	}
+	body, err = json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	res := k.client.Patch(api.MergePatchType).AbsPath(append(segments, obj.GetName())...).Body(body).Do()
+	if err := res.Error(); err != nil {
+		return nil, fmt.Errorf("Failed to patch %s %s: %s", result.Kind, result.Name, err)
+	}
+	patched, err := decodeResult(res)
+	if err != nil {
+		return nil, err
+	}
+
+	if patched.GetResourceVersion() == live.GetResourceVersion() {
+		result.Action = "unchanged"
+	} else {
+		result.Action = "configured"
+	}
+
+	return result, nil
+}
+
+// Annotate sets annotations on an existing object with a merge patch, leaving the rest of it,
+// including its last applied configuration, as it is.
+func (k *KubeClient) Annotate(obj *runtime.Unstructured, annotations map[string]string) error {
+	segments, err := k.resourcePath(obj)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
 	if err != nil {
-		exitErr := err.(*exec.ExitError)
-		log.Printf("Command 'kubectl -n %s apply -f %s' returned with non-zero code: %s\n", namespace, out.Name(), exitErr.String())
 		return err
 	}
 
+	err = k.client.Patch(api.MergePatchType).AbsPath(append(segments, obj.GetName())...).Body(body).Do().Error()
+	if err != nil {
+		return fmt.Errorf("Failed to annotate %s %s: %s", obj.GetKind(), obj.GetName(), err)
+	}
+
 	return nil
 }
+
+// List returns the objects in namespace that match the label selector, across every namespaced resource type.
+func (k *KubeClient) List(namespace, selector string) ([]*runtime.Unstructured, error) {
+	resources, err := k.discovery.ServerPreferredNamespacedResources()
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return nil, fmt.Errorf("Failed to discover resources: %s", err)
+	}
+
+	var objects []*runtime.Unstructured
+	for _, gvr := range resources {
+		segments := append(groupVersionPath(gvr.GroupVersion().String()), "namespaces", namespace, gvr.Resource)
+		res := k.client.Get().AbsPath(segments...).Param("labelSelector", selector).Do()
+		if err := res.Error(); err != nil {
+			// Not every resource supports listing
+			if errors.IsMethodNotSupported(err) || errors.IsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("Failed to list %s: %s", gvr.Resource, err)
+		}
+		body, err := res.Raw()
+		if err != nil {
+			return nil, err
+		}
+		list := &runtime.UnstructuredList{}
+		if err := list.UnmarshalJSON(body); err != nil {
+			return nil, err
+		}
+
+		// Items in a list don't always carry their own type
+		kind := strings.TrimSuffix(list.GetKind(), "List")
+		for _, item := range list.Items {
+			if item.GetKind() == "" {
+				item.SetKind(kind)
+			}
+			if item.GetAPIVersion() == "" {
+				item.SetAPIVersion(gvr.GroupVersion().String())
+			}
+			objects = append(objects, item)
+		}
+	}
+
+	return objects, nil
+}
+
+// Delete removes obj and lets the garbage collector remove its dependents.
+// Deleting an object that does not exist is not an error.
+func (k *KubeClient) Delete(obj *runtime.Unstructured) error {
+	segments, err := k.resourcePath(obj)
+	if err != nil {
+		return err
+	}
+
+	orphan := false
+	body, err := json.Marshal(&v1.DeleteOptions{
+		TypeMeta: unversioned.TypeMeta{
+			Kind:       "DeleteOptions",
+			APIVersion: "v1",
+		},
+		OrphanDependents: &orphan,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = k.client.Delete().AbsPath(append(segments, obj.GetName())...).Body(body).Do().Error()
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("Failed to delete %s %s: %s", obj.GetKind(), obj.GetName(), err)
+	}
+
+	return nil
+}
+
+// JobLogs returns the logs of every container in the pods of a Job, keyed by pod name.
+func (k *KubeClient) JobLogs(job *runtime.Unstructured) (map[string]string, error) {
+	podsPath := []string{"/api", "v1", "namespaces", job.GetNamespace(), "pods"}
+	body, err := k.client.Get().AbsPath(podsPath...).Param("labelSelector", "job-name="+job.GetName()).Do().Raw()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list pods: %s", err)
+	}
+	pods := &runtime.UnstructuredList{}
+	if err := pods.UnmarshalJSON(body); err != nil {
+		return nil, err
+	}
+
+	logs := make(map[string]string)
+	for _, pod := range pods.Items {
+		containers, _ := nestedField(pod.Object, "spec", "containers").([]interface{})
+		var output []string
+		for _, c := range containers {
+			container, _ := c.(map[string]interface{})
+			name, _ := container["name"].(string)
+			raw, err := k.client.Get().AbsPath(append(podsPath, pod.GetName(), "log")...).Param("container", name).Do().Raw()
+			if err != nil {
+				return nil, fmt.Errorf("Failed to get logs of %s in pod %s: %s", name, pod.GetName(), err)
+			}
+			if len(containers) > 1 {
+				output = append(output, "["+name+"]")
+			}
+			output = append(output, string(raw))
+		}
+		logs[pod.GetName()] = strings.Join(output, "\n")
+	}
+
+	return logs, nil
+}
+
+// objectKey identifies an object within a cluster.
+// The API group is left out since the same object can be served by more than one group.
+func objectKey(obj *runtime.Unstructured) string {
+	return fmt.Sprintf("%s/%s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+}
+
+func decodeResult(res rest.Result) (*runtime.Unstructured, error) {
+	body, err := res.Raw()
+	if err != nil {
+		return nil, err
+	}
+	obj := &runtime.Unstructured{}
+	if err := obj.UnmarshalJSON(body); err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// kubeApply applies manifests one object at a time, in dependency order.
+// Every object gets provenance labels and annotations first.
+// Custom resources are only applied once the CRD defining them is established.
+func kubeApply(logger *log.Logger, manifests []*Manifest) ([]*ApplyResult, error) {
+	sortManifests(logger, manifests)
+	deployedAt := time.Now()
+
+	crds := make(map[string]*runtime.Unstructured)
+	var results []*ApplyResult
+	for _, m := range manifests {
+		obj := m.Object
+		if crd, ok := crds[resourceKey(obj)]; ok {
+			if err := waitForEstablished(logger, crd); err != nil {
+				return results, fmt.Errorf("%s: %s", m, err)
+			}
+			delete(crds, resourceKey(obj))
+		}
+
+		addProvenance(m, deployedAt)
+		result, err := kube.Apply(obj)
+		if err != nil {
+			return results, fmt.Errorf("%s: %s", m, err)
+		}
+		results = append(results, result)
+
+		if obj.GetKind() == "CustomResourceDefinition" {
+			crds[crdKey(obj)] = obj
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// dirtyMarker separates the commit from the content hash in the ref of a deploy with uncommitted changes.
+const dirtyMarker = "-dirty-"
+
+// localRepoPath returns the directory of a repository given as a local path or file:// URI.
+func localRepoPath(uri string) (string, bool) {
+	dir := uri
+	switch {
+	case strings.HasPrefix(uri, "file://"):
+		u, err := url.Parse(uri)
+		if err != nil {
+			return "", false
+		}
+		dir = u.Path
+	case strings.HasPrefix(uri, "~/"):
+		dir = filepath.Join(os.Getenv("HOME"), uri[2:])
+	case uri == "." || uri == ".." || strings.HasPrefix(uri, "/") || strings.HasPrefix(uri, "./") || strings.HasPrefix(uri, "../"):
+	default:
+		return "", false
+	}
+
+	return filepath.Clean(dir), true
+}
+
+// splitDirtyRef returns the commit and content hash of a ref returned by cloneLocal.
+// The content hash is empty if no uncommitted changes were deployed.
+func splitDirtyRef(ref string) (string, string) {
+	i := strings.Index(ref, dirtyMarker)
+	if i < 0 {
+		return ref, ""
+	}
+
+	return ref[:i], ref[i+len(dirtyMarker):]
+}
+
+// openLocalRepo opens a local repository and returns its working tree, which is empty for bare repositories.
+func openLocalRepo(dir string) (*git.Repository, string, string, error) {
+	gitDir := filepath.Join(dir, ".git")
+	info, err := os.Stat(gitDir)
+	switch {
+	case err == nil && info.IsDir():
+		repo, err := git.NewFilesystemRepository(gitDir)
+		return repo, gitDir, dir, err
+	case err == nil:
+		// Worktrees and submodules have a .git file pointing to the repository
+		content, err := ioutil.ReadFile(gitDir)
+		if err != nil {
+			return nil, "", "", err
+		}
+		target := strings.TrimSpace(strings.TrimPrefix(string(content), "gitdir:"))
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(dir, target)
+		}
+		repo, err := git.NewFilesystemRepository(target)
+		return repo, target, dir, err
+	case os.IsNotExist(err):
+		repo, err := git.NewFilesystemRepository(dir)
+		return repo, dir, "", err
+	}
+
+	return nil, "", "", err
+}
+
+// resolveLocalCommit finds the commit a ref points to in a local repository.
+// Besides HEAD it takes the same refs as resolveCommit, with the local branches instead of those on origin.
+func resolveLocalCommit(repo *git.Repository, gitDir, refName string) (*git.Commit, error) {
+	if refName == "HEAD" {
+		head, err := repo.Head()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read HEAD: %s", err)
+		}
+		return peelCommit(repo, head.Hash())
+	}
+	if commit, hash := splitDirtyRef(refName); hash != "" {
+		return nil, fmt.Errorf("%s was deployed with uncommitted changes on top of %s, they can't be deployed again", refName, commit)
+	}
+	if len(refName) == 40 && hexRef.MatchString(refName) {
+		commit, err := peelCommit(repo, plumbing.NewHash(refName))
+		if err != nil {
+			return nil, fmt.Errorf("Unknown commit %s: %s", refName, err)
+		}
+		return commit, nil
+	}
+
+	names := []string{refName}
+	if !strings.HasPrefix(refName, "refs/") {
+		names = []string{"refs/tags/" + refName, "refs/heads/" + refName}
+	}
+	candidates := make(map[plumbing.Hash][]string)
+	for _, name := range names {
+		ref, err := repo.Ref(plumbing.ReferenceName(name), true)
+		if err != nil {
+			continue
+		}
+		commit, err := peelCommit(repo, ref.Hash())
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve %s: %s", name, err)
+		}
+		candidates[commit.Hash] = append(candidates[commit.Hash], name)
+	}
+	if hexRef.MatchString(refName) {
+		hashes, err := objectsWithPrefix(gitDir, strings.ToLower(refName))
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hashes {
+			if commit, err := peelCommit(repo, h); err == nil {
+				candidates[commit.Hash] = append(candidates[commit.Hash], "commit "+h.String())
+			}
+		}
+	}
+
+	h, err := singleCandidate(refName, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.Commit(h)
+}
+
+// cloneLocal writes the k8s files of a local repository at refName to the workspace, like cloneFiles does for remote ones.
+// With uncommitted set, HEAD is read from the working tree, including changes and files that are not committed.
+// If those differ from HEAD the returned ref is the commit followed by dirtyMarker and the content hash of the files.
+func cloneLocal(logger *log.Logger, repoURI, dir, folder, refName string, uncommitted bool, fileFunc func(string, string) error) (string, error) {
+	logger.Println(repoURI, refName)
+
+	repo, gitDir, worktree, err := openLocalRepo(dir)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open %s: %s", dir, err)
+	}
+	commit, err := resolveLocalCommit(repo, gitDir, refName)
+	if err != nil {
+		return "", err
+	}
+	files, err := kubeFiles(repo, commit, folder)
+	if err != nil {
+		return "", err
+	}
+
+	ref := commit.Hash.String()
+	var contents map[string][]byte
+	if uncommitted && refName == "HEAD" {
+		if worktree == "" {
+			return "", fmt.Errorf("%s is a bare repository, it has no uncommitted changes to deploy", dir)
+		}
+		var changed []kubeFile
+		changed, contents, err = worktreeFiles(worktree, folder)
+		if err != nil {
+			return "", err
+		}
+		if contentHash(changed) != contentHash(files) {
+			ref += dirtyMarker + contentHash(changed)
+		}
+		files = changed
+	}
+
+	repoPath := repoWorkspace(repoURI, ref)
+	for _, f := range files {
+		abs := filepath.Join(repoPath, f.name)
+		if contents != nil {
+			os.MkdirAll(filepath.Dir(abs), 0777)
+			err = ioutil.WriteFile(abs, contents[f.name], f.mode)
+		} else {
+			err = writeBlob(repo, f, abs)
+		}
+		if err != nil {
+			return "", err
+		}
+		// The files are rendered with the commit they are based on as TAG
+		if err := fileFunc(repoPath+"/"+f.name, commit.Hash.String()); err != nil {
+			return "", err
+		}
+	}
+
+	return ref, nil
+}
+
+// worktreeFiles lists the regular files under folder in a working tree, tracked or not, and reads them.
+func worktreeFiles(worktree, folder string) ([]kubeFile, map[string][]byte, error) {
+	var files []kubeFile
+	contents := make(map[string][]byte)
+
+	root := filepath.Join(worktree, strings.Trim(folder, "/"))
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(worktree, path)
+		if err != nil {
+			return err
+		}
+		// Git only records whether a file is executable
+		mode := os.FileMode(0644)
+		if info.Mode()&0111 != 0 {
+			mode = 0755
+		}
+		name := filepath.ToSlash(rel)
+		files = append(files, kubeFile{name: name, mode: mode, hash: plumbing.ComputeHash(plumbing.BlobObject, content)})
+		contents[name] = content
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return files, contents, nil
+}
+
+// contentHash is the SHA-256 of the names, modes and blob hashes of a set of files.
+func contentHash(files []kubeFile) string {
+	lines := make([]string, 0, len(files))
+	for _, f := range files {
+		lines = append(lines, fmt.Sprintf("%o %s %s\n", f.mode, f.hash, f.name))
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "")))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -13,20 +13,39 @@ import (
 
 	"log"
 
-	"path"
+	"path/filepath"
+
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 var (
-	config     *Config
-	configFile = flag.String("config", "", "Config file")
-	redisAddr  = flag.String("redis", "", "Redis state DB. Ex: localhost:6379")
-	namespace  = flag.String("namespace", "", "Namespace")
-	artifact   = flag.String("artifact", "", "Create YAML with what was deployed")
-	clearState = flag.Bool("clear-state", false, "Clear the state for this namespace")
-	state      State
-	err        error
+	config        *Config
+	configFile    = flag.String("config", "", "Config file")
+	redisAddr     = flag.String("redis", "", "Redis state DB. Ex: localhost:6379")
+	namespace     = flag.String("namespace", "", "Namespace")
+	artifact      = flag.String("artifact", "", "Create YAML with what was deployed")
+	clearState    = flag.Bool("clear-state", false, "Clear the state for this namespace")
+	kubeconfig    = flag.String("kubeconfig", "", "Path to kubeconfig. Defaults to $KUBECONFIG or ~/.kube/config")
+	kubeCtx       = flag.String("context", "", "Kubernetes context to use. Defaults to the current context")
+	targetName    = flag.String("target", "", "Only deploy to the target with this name")
+	destroyMode   = flag.Bool("destroy", false, "Delete everything deployed to the namespace and clear its state")
+	confirm       = flag.String("confirm", "", "Name of the protected namespace to destroy")
+	pruneCacheAge = flag.Duration("prune-cache", 0, "Remove git caches that have not been used for this long, then exit. Ex: 168h")
+	gcMode        = flag.Bool("gc", false, "Destroy ephemeral namespaces that expired or whose branch is gone")
+	diffMode      = flag.Bool("diff", false, "Show what a deploy would change without applying anything")
+	validateMode  = flag.Bool("validate", false, "Validate the rendered manifests offline without applying anything")
+	state         State
+	kube          *KubeClient
+	currentTarget string
+	err           error
+
+	// stdLogger logs like the log package, for code that takes a logger but isn't deploying a single repository
+	stdLogger = log.New(os.Stderr, "", log.LstdFlags)
+
+	// version is set at build time with -ldflags "-X main.version=..."
+	version = "dev"
 )
 
 func main() {
@@ -37,7 +56,7 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		err = state.Clear(*namespace)
+		err = state.Clear(statePrefix(*targetName, *namespace))
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -80,6 +99,45 @@ func main() {
 		os.Mkdir(config.BaseDir, 0700)
 	}
 
+	// Set CacheDir
+	if config.CacheDir == "<no value>" || config.CacheDir == "" {
+		config.CacheDir = filepath.Join(config.BaseDir, "cache")
+	}
+
+	if *pruneCacheAge > 0 {
+		if err := pruneCache(*pruneCacheAge); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	// Every run gets its own workspace. Those of earlier runs are removed once they are past retention
+	var retention time.Duration
+	if config.WorkspaceRetention != "" && config.WorkspaceRetention != "<no value>" {
+		retention, err = time.ParseDuration(config.WorkspaceRetention)
+		if err != nil {
+			log.Fatal("Invalid workspaceRetention: ", err)
+		}
+	}
+	if err := pruneWorkspaces(retention); err != nil {
+		log.Println("Failed to remove old workspaces:", err)
+	}
+	closeWorkspace, err := openWorkspace(retention)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeWorkspace()
+
+	// Set Timeout
+	if config.Timeout == "<no value>" || config.Timeout == "" {
+		config.Timeout = "5m"
+	}
+	defaultTimeout, err := time.ParseDuration(config.Timeout)
+	if err != nil {
+		log.Fatal("Invalid timeout: ", err)
+	}
+
 	// Connect to Redis if address given
 	if *redisAddr != "" {
 		state, err = NewRedisState(*redisAddr)
@@ -88,26 +146,31 @@ func main() {
 		}
 	}
 
-	log.Println("Namespace:", config.Namespace)
-
-	// Create namespace if it doesn't already exist
-	if !namespaceExists(config.Namespace) {
-		err = kubeCreateNamespace(config.Namespace)
-		if err != nil {
-			log.Fatal(err)
+	// Without targets in the config we deploy to the cluster and namespace given on the command line
+	targets := config.Targets
+	if len(targets) == 0 {
+		targets = []Target{{}}
+	}
+	if *targetName != "" {
+		targets = selectTarget(targets, *targetName)
+		if len(targets) == 0 {
+			log.Fatalf("No target named %s in config", *targetName)
 		}
 	}
 
-	// Record environment variable for Namespace
-	envMap := envToMap()
-	envMap["NAMESPACE"] = config.Namespace
+	// Read environment variables that will signal what repo to update to some commit
+	updateRepo := os.Getenv(config.UpdateRepoVar)
+	updateRepoRef := os.Getenv(config.UpdateRefVar)
 
 	// Start recording values that we can later write to the "artifact" file
 	outConf := Config{
 		KubeFolder: config.KubeFolder,
+		Cluster:    config.Cluster,
+		Auth:       config.Auth,
 	}
 
 	// If we are in a repo we should record the remote uri and current commit
+	var localRepo *Repository
 	if _, err := os.Stat(".git"); err == nil {
 		localRemote, err := getLocalRemote(".git")
 		if err != nil {
@@ -117,88 +180,161 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		wd, err := os.Getwd()
+		localName, err := localRepoName()
 		if err != nil {
 			log.Fatal(err)
 		}
-		localName := path.Base(wd)
-		outConf.Repositories = append(outConf.Repositories, Repository{
+		localRepo = &Repository{
 			Name:   localName,
 			URI:    localRemote,
 			Commit: localRef,
-		})
+		}
 	}
 
-	// Apply k8s files in local repo
-	if config.KubeFolder != "" && config.KubeFolder != "<no value>" {
-		config.KubeFolder = strings.TrimSuffix(config.KubeFolder, "/")
-		files, err := ioutil.ReadDir(config.KubeFolder)
+	defaultNamespace := config.Namespace
+	repositories := config.Repositories
+	var findings []*Finding
+	for _, target := range targets {
+		// Fill in the target from the global config and command line
+		if target.Namespace == "" || *namespace != "" {
+			target.Namespace = defaultNamespace
+		}
+		if target.Kubeconfig == "" {
+			target.Kubeconfig = *kubeconfig
+		}
+		if target.Context == "" {
+			target.Context = *kubeCtx
+		}
+		if target.Cluster == nil {
+			target.Cluster = config.Cluster
+		}
+		// A target in an artifact lists the repositories that were deployed to it
+		repos := repositories
+		if len(target.Repositories) > 0 {
+			repos = target.Repositories
+		}
+		repos, err = expandComponents(repos)
 		if err != nil {
 			log.Fatal(err)
 		}
-		for _, f := range files {
-			log.Println("./" + config.KubeFolder + "/" + f.Name())
-			err = kubeApply(config.KubeFolder+"/"+f.Name(), "", envMap)
+
+		currentTarget = target.Name
+		config.Namespace = target.Namespace
+		if target.Name != "" {
+			log.Println("Target:", target.Name)
+		}
+
+		// Record environment variables for Namespace and Target, and the target's own variables
+		envMap := envToMap()
+		envMap["NAMESPACE"] = config.Namespace
+		envMap["TARGET"] = target.Name
+		for key, value := range target.Vars {
+			envMap[key] = value
+		}
+
+		// Validation is done offline, nothing is applied
+		if *validateMode {
+			targetFindings, err := validateDeploy(repos, envMap, updateRepo, updateRepoRef)
 			if err != nil {
-				log.Fatal("Failed to apply kubernetes config: ", err)
+				log.Fatal(err)
 			}
+			findings = append(findings, targetFindings...)
+			continue
 		}
-	}
 
-	// Read environment variables that will signal what repo to update to some commit
-	updateRepo := os.Getenv(config.UpdateRepoVar)
-	updateRepoRef := os.Getenv(config.UpdateRefVar)
+		if *destroyMode && isProtected(config.Namespace) && *confirm != config.Namespace {
+			log.Fatalf("Namespace %s is protected, use -confirm %s to destroy it", config.Namespace, config.Namespace)
+		}
 
-	// Loop over repositories
-	for _, repo := range config.Repositories {
-		statePath := fmt.Sprintf("k8s-deployer/%s/%s", config.Namespace, repo.URI)
-		var refName string
-		oldRef := repo.Commit
-
-		// If this repository is the one signaled in updateRepo we should apply that ref,
-		// otherwise apply ref either from state db or from config.
-		// If neither exist apply from DefaultBranch.
-		if repo.Name != "" && repo.Name == updateRepo && updateRepoRef != "" {
-			refName = os.Getenv(config.UpdateRefVar)
-		} else {
-			if oldRef == "" {
-				if state != nil {
-					oldRef, _ = state.Get(statePath)
+		// Connect to Kubernetes
+		kube, err = NewKubeClient(target.Kubeconfig, target.Context)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Make sure we are talking to the cluster the config was meant for
+		if err := verifyCluster(target.Cluster); err != nil {
+			log.Fatal(err)
+		}
+
+		// Garbage collection looks at every namespace in the cluster, not just the deploy namespace
+		if *gcMode {
+			if err := collectGarbage(repos, defaultTimeout); err != nil {
+				log.Fatal(err)
+			}
+			continue
+		}
+
+		log.Println("Namespace:", config.Namespace)
+
+		// Destroy removes the objects first, the state is only cleared once they are gone
+		if *destroyMode {
+			deleted, err := destroyNamespace(repos, defaultTimeout)
+			for _, result := range deleted {
+				log.Println(result)
+			}
+			if err != nil {
+				log.Fatal("Failed to destroy namespace: ", err)
+			}
+			if state != nil {
+				if err := state.Clear(statePrefix(currentTarget, config.Namespace)); err != nil {
+					log.Fatal(err)
 				}
 			}
-			if oldRef != "" {
-				refName = oldRef
-			} else {
-				refName = "refs/remotes/origin/" + config.DefaultBranch
+			continue
+		}
+
+		if err := checkOwners(repos); err != nil {
+			log.Fatal(err)
+		}
+
+		// In diff mode we only show what would change, neither the cluster nor the state is modified
+		if *diffMode {
+			plan, err := planDeploy(repos, envMap, updateRepo, updateRepoRef)
+			if err != nil {
+				log.Fatal(err)
 			}
+			plan.Print(os.Stdout)
+			continue
 		}
 
-		// Clone files from repository and if it has prefix of KubeFolder we execute this function.
-		// If ref has changed we should apply the k8s file.
-		ref, err := cloneFiles(repo.URI, refName, func(filePath, ref string) error {
-			log.Println(repo.URI, ref, path.Base(filePath))
-			if oldRef != ref {
-				err = kubeApply(filePath, ref, envMap)
-				if err != nil {
-					return err
-				}
+		deployed := deployTarget(repos, envMap, updateRepo, updateRepoRef, defaultTimeout)
+		if localRepo != nil {
+			deployed = append([]Repository{*localRepo}, deployed...)
+		}
+
+		// Summary of what was deployed
+		for _, repo := range deployed {
+			if repo.Tag != "" {
+				log.Printf("%s: %s (%s)\n", repositoryName(repo), repo.Commit, repo.Tag)
+			} else if repo.Dirty {
+				log.Printf("%s: %s with uncommitted changes (content %s)\n", repositoryName(repo), repo.Commit, repo.ContentHash)
+			} else {
+				log.Printf("%s: %s\n", repositoryName(repo), repo.Commit)
 			}
+			for _, name := range repo.Pruned {
+				log.Printf("%s: pruned %s\n", repositoryName(repo), name)
+			}
+		}
 
-			return nil
-		})
-		if err != nil {
-			log.Fatalf("Failure while cloning files for %s: ", repo.URI, err)
+		if len(config.Targets) == 0 {
+			outConf.Repositories = deployed
+		} else {
+			target.Repositories = deployed
+			outConf.Targets = append(outConf.Targets, target)
 		}
+	}
 
-		// Record state
-		if state != nil {
-			state.Set(statePath, ref)
+	if *validateMode {
+		printFindings(os.Stdout, findings)
+		if countProblems(findings) > 0 {
+			os.Exit(1)
 		}
-		outConf.Repositories = append(outConf.Repositories, Repository{
-			Name:   repo.Name,
-			URI:    repo.URI,
-			Commit: ref,
-		})
+
+		return
+	}
+	if *diffMode || *destroyMode || *gcMode {
+		return
 	}
 
 	// If the -artifact parameter was given, write outConf to file.
@@ -210,3 +346,161 @@ func main() {
 		ioutil.WriteFile(*artifact, outConfBytes, 0644)
 	}
 }
+
+// deployTarget deploys the local repo and repos to the current target and returns what was deployed.
+func deployTarget(repos []Repository, envMap map[string]string, updateRepo, updateRepoRef string, defaultTimeout time.Duration) []Repository {
+	// Create namespace if it doesn't already exist, and set it up from the namespace template
+	err := provisionNamespace(envMap)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := stampNamespace(envMap); err != nil {
+		log.Fatal(err)
+	}
+
+	// Apply k8s files in local repo
+	local, err := renderLocal(envMap)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(local) > 0 {
+		applied, err := kubeApply(stdLogger, local)
+		for _, result := range applied {
+			log.Println(result)
+		}
+		if err != nil {
+			log.Fatal("Failed to apply kubernetes config: ", err)
+		}
+		if err := waitForRollout(stdLogger, applied, defaultTimeout); err != nil {
+			log.Fatal("Rollout failed: ", err)
+		}
+	}
+
+	// Deploy the repositories, the ones that don't depend on each other at the same time
+	deployed := make([]Repository, len(repos))
+	err = runGraph(repos, config.Workers, func(i int) error {
+		repo := repos[i]
+		logger := log.New(os.Stderr, "["+repositoryName(repo)+"] ", log.LstdFlags)
+		refName, oldRef, release, err := resolveRef(logger, repo, statePath(repo), updateRepo, updateRepoRef)
+		if err != nil {
+			return fmt.Errorf("Failed to resolve the ref of %s: %s", repo.URI, err)
+		}
+
+		timeout := defaultTimeout
+		if repo.Timeout != "" {
+			timeout, err = time.ParseDuration(repo.Timeout)
+			if err != nil {
+				return fmt.Errorf("Invalid timeout for %s: %s", repo.URI, err)
+			}
+		}
+
+		// Clone files from repository and apply the k8s files if the ref has changed.
+		// If that fails we go back to the ref that was deployed before, the failed ref is never recorded.
+		ref, pruned, err := deployRef(logger, repo, refName, oldRef, envMap, timeout)
+		if err != nil {
+			if ref != "" && oldRef != "" && oldRef != ref {
+				if rollbackErr := rollback(logger, repo, ref, oldRef, envMap, timeout); rollbackErr != nil {
+					logger.Printf("Rollback of %s failed: %s\n", repo.URI, rollbackErr)
+				}
+			}
+			return fmt.Errorf("Deploy of %s failed: %s", repo.URI, err)
+		}
+
+		// Record state
+		if state != nil {
+			state.Set(statePath(repo), ref)
+		}
+		result := Repository{
+			Name:        repo.Name,
+			URI:         repo.URI,
+			Commit:      ref,
+			Timeout:     repo.Timeout,
+			Prune:       repo.Prune,
+			DependsOn:   repo.DependsOn,
+			Version:     repo.Version,
+			Auth:        repo.Auth,
+			Uncommitted: repo.Uncommitted,
+			Component:   repo.Component,
+			Path:        repo.Path,
+			KubeFolder:  kubeFolder(repo),
+			Branch:      repositoryBranch(repo),
+			Namespace:   repo.Namespace,
+			Vars:        repo.Vars,
+		}
+		// Uncommitted changes can't be deployed again, the artifact only names the commit they were made on
+		result.Commit, result.ContentHash = splitDirtyRef(ref)
+		result.Dirty = result.ContentHash != ""
+		if release != nil {
+			result.Tag = release.Tag
+			result.PreviousTag = release.PreviousTag
+			result.PreviousCommit = release.PreviousCommit
+		}
+		for _, p := range pruned {
+			result.Pruned = append(result.Pruned, strings.ToLower(p.Kind)+"/"+p.Name)
+		}
+		deployed[i] = result
+
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return deployed
+}
+
+// selectTarget returns the target with the given name.
+func selectTarget(targets []Target, name string) []Target {
+	for _, target := range targets {
+		if target.Name == name {
+			return []Target{target}
+		}
+	}
+
+	return nil
+}
+
+// resolveRef returns the ref to deploy for a repository and the ref that is currently deployed.
+// If this repository is the one signaled in updateRepo we should apply that ref,
+// otherwise apply ref either from state db or from config.
+// A repository with a version follows the highest matching tag, unless a commit is pinned in the config.
+// A local repository follows its HEAD.
+// If neither exist apply from the branch of the repository, or DefaultBranch.
+func resolveRef(logger *log.Logger, repo Repository, statePath, updateRepo, updateRepoRef string) (string, string, *Release, error) {
+	oldRef := repo.Commit
+	if oldRef == "" && state != nil {
+		oldRef, _ = state.Get(statePath)
+	}
+
+	// A signal for a monorepo updates all its components
+	if updateRepoRef != "" && (repo.Name != "" && repo.Name == updateRepo || repo.Component != "" && repo.Component == updateRepo) {
+		return updateRepoRef, oldRef, nil, nil
+	}
+	if _, ok := localRepoPath(repo.URI); ok && repo.Commit == "" {
+		// A local repository is deployed as it is checked out now
+		return "HEAD", oldRef, nil, nil
+	}
+	if repo.Dirty {
+		logger.Printf("%s was deployed with uncommitted changes, deploying commit %s without them\n", repo.URI, repo.Commit)
+	}
+	if repo.Version != "" && repo.Commit == "" {
+		release, err := selectRelease(repo.URI, repo.Version, oldRef)
+		if err != nil {
+			return "", oldRef, nil, err
+		}
+		previous := "nothing"
+		if release.PreviousTag != "" {
+			previous = fmt.Sprintf("%s (%s)", release.PreviousTag, release.PreviousCommit)
+		} else if oldRef != "" {
+			previous = oldRef
+		}
+		logger.Printf("Version %s picked %s (%s), previously %s\n", repo.Version, release.Tag, release.Commit, previous)
+
+		return "refs/tags/" + release.Tag, oldRef, release, nil
+	}
+	if oldRef != "" {
+		return oldRef, oldRef, nil, nil
+	}
+
+	return "refs/remotes/origin/" + repositoryBranch(repo), oldRef, nil, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/pkg/runtime"
+)
+
+// Manifest is a single object rendered from a Kubernetes config, together with where it came from.
+type Manifest struct {
+	Repository string
+	// URI and Commit are the repository and commit the manifest was rendered from, if known.
+	URI    string
+	Commit string
+	File   string
+	// Index is the position of the document in the file, starting at 0.
+	Index int
+	// Line is the line in the rendered file the document starts on, starting at 1.
+	Line int
+	// Source is the rendered document.
+	Source []byte
+	Object *runtime.Unstructured
+}
+
+func (m *Manifest) String() string {
+	source := fmt.Sprintf("%s document %d", m.File, m.Index)
+	if m.Repository != "" {
+		source = m.Repository + ": " + source
+	}
+	if m.Object == nil {
+		return source
+	}
+
+	return fmt.Sprintf("%s (%s %s)", source, m.Object.GetKind(), m.Object.GetName())
+}
+
+// document is one YAML document of a rendered file.
+type document struct {
+	Index int
+	Line  int
+	Data  []byte
+}
+
+// renderFile runs a Kubernetes config through the template renderer.
+func renderFile(kubefile, tag string, env map[string]string) ([]byte, error) {
+	configBytes, err := ioutil.ReadFile(kubefile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read file %s: %s", kubefile, err)
+	}
+
+	env["TAG"] = tag
+	return renderTemplate(string(configBytes), env)
+}
+
+// renderTemplate renders text with the variables in env and the functions Kubernetes configs can use.
+func renderTemplate(text string, env map[string]string) ([]byte, error) {
+	funcMap := template.FuncMap{
+		"ToUpper": strings.ToUpper,
+		"ToLower": strings.ToLower,
+		"Title":   strings.Title,
+		"TrimPrefix": func(t, s string) string {
+			return strings.TrimPrefix(s, t)
+		},
+		"TrimSuffix": func(t, s string) string {
+			return strings.TrimSuffix(s, t)
+		},
+		"Replace": func(f, t, s string) string {
+			return strings.Replace(s, f, t, 1000)
+		},
+	}
+
+	tmpl, err := template.New("config").Funcs(funcMap).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create template: %s", err)
+	}
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, env)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to render template: %s", err)
+	}
+
+	return out.Bytes(), nil
+}
+
+// splitDocuments splits a YAML stream on "---" separators.
+// Documents with nothing but whitespace and comments, like the ones left by template conditionals, are dropped.
+func splitDocuments(data []byte) []*document {
+	var documents []*document
+	current := &document{Line: 1}
+	empty := true
+	index := 0
+
+	flush := func() {
+		if !empty {
+			documents = append(documents, current)
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if text == "---" || strings.HasPrefix(text, "--- ") {
+			flush()
+			if !empty {
+				index++
+			}
+			current = &document{Index: index, Line: line + 1}
+			empty = true
+			continue
+		}
+
+		trimmed := strings.TrimSpace(text)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			empty = false
+		}
+		current.Data = append(current.Data, text...)
+		current.Data = append(current.Data, '\n')
+	}
+	flush()
+
+	return documents
+}
+
+// decodeDocument decodes a document into an object and checks that it can be applied.
+// It returns nil if the document holds no object.
+func decodeDocument(doc *document) (*runtime.Unstructured, error) {
+	jsonBytes, err := yaml.YAMLToJSON(doc.Data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode: %s", err)
+	}
+	if s := strings.TrimSpace(string(jsonBytes)); s == "null" || s == "{}" {
+		return nil, nil
+	}
+
+	obj := &runtime.Unstructured{}
+	if err := obj.UnmarshalJSON(jsonBytes); err != nil {
+		return nil, fmt.Errorf("Failed to decode: %s", err)
+	}
+
+	var missing []string
+	if obj.GetAPIVersion() == "" {
+		missing = append(missing, "apiVersion")
+	}
+	if obj.GetKind() == "" {
+		missing = append(missing, "kind")
+	}
+	if obj.GetName() == "" {
+		missing = append(missing, "metadata.name")
+	}
+	if len(missing) > 0 {
+		return obj, fmt.Errorf("Missing %s", strings.Join(missing, ", "))
+	}
+
+	return obj, nil
+}
+
+// renderManifests renders a Kubernetes config and splits it into one manifest per object.
+// Objects without a namespace are put in namespace.
+// If owner is set the objects are labeled as belonging to that repository in the deploy namespace.
+func renderManifests(kubefile, tag, owner, namespace string, env map[string]string) ([]*Manifest, error) {
+	data, err := renderFile(kubefile, tag, env)
+	if err != nil {
+		if owner != "" {
+			return nil, fmt.Errorf("%s: %s", owner, err)
+		}
+		return nil, err
+	}
+
+	var manifests []*Manifest
+	for _, doc := range splitDocuments(data) {
+		m := &Manifest{
+			Repository: owner,
+			File:       kubefile,
+			Index:      doc.Index,
+			Line:       doc.Line,
+			Source:     doc.Data,
+		}
+		obj, err := decodeDocument(doc)
+		m.Object = obj
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", m, err)
+		}
+		if obj == nil {
+			continue
+		}
+
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(namespace)
+		}
+		if owner != "" {
+			labels := obj.GetLabels()
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			labels[repositoryLabel] = labelValue(owner)
+			labels[namespaceLabel] = labelValue(config.Namespace)
+			obj.SetLabels(labels)
+		}
+		manifests = append(manifests, m)
+	}
+
+	return manifests, nil
+}
+
+// manifestObjects returns the objects of manifests.
+func manifestObjects(manifests []*Manifest) []*runtime.Unstructured {
+	objects := make([]*runtime.Unstructured, len(manifests))
+	for i, m := range manifests {
+		objects[i] = m.Object
+	}
+
+	return objects
+}
+
+// labelValue turns s into a valid label value: at most 63 alphanumerics, '-', '_' or '.',
+// starting and ending with an alphanumeric.
+func labelValue(s string) string {
+	value := []rune(s)
+	for i, r := range value {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			value[i] = '-'
+		}
+	}
+	if len(value) > 63 {
+		value = value[:63]
+	}
+
+	return strings.Trim(string(value), "-_.")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitDocuments(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []document
+	}{
+		{
+			name: "single document",
+			data: "kind: Service\n",
+			want: []document{{Index: 0, Line: 1, Data: []byte("kind: Service\n")}},
+		},
+		{
+			name: "separated documents",
+			data: "kind: Service\n---\nkind: Deployment\n",
+			want: []document{
+				{Index: 0, Line: 1, Data: []byte("kind: Service\n")},
+				{Index: 1, Line: 3, Data: []byte("kind: Deployment\n")},
+			},
+		},
+		{
+			name: "leading separator",
+			data: "---\nkind: Service\n",
+			want: []document{{Index: 0, Line: 2, Data: []byte("kind: Service\n")}},
+		},
+		{
+			name: "empty and comment documents are dropped",
+			data: "kind: Service\n---\n\n# disabled\n---\nkind: Deployment\n---\n",
+			want: []document{
+				{Index: 0, Line: 1, Data: []byte("kind: Service\n")},
+				{Index: 1, Line: 6, Data: []byte("kind: Deployment\n")},
+			},
+		},
+		{
+			name: "separator with a comment",
+			data: "kind: Service\n--- # next\nkind: Deployment\n",
+			want: []document{
+				{Index: 0, Line: 1, Data: []byte("kind: Service\n")},
+				{Index: 1, Line: 3, Data: []byte("kind: Deployment\n")},
+			},
+		},
+		{
+			name: "dashes inside a value",
+			data: "data:\n  text: |\n    ----\n",
+			want: []document{{Index: 0, Line: 1, Data: []byte("data:\n  text: |\n    ----\n")}},
+		},
+		{
+			name: "nothing",
+			data: "",
+			want: nil,
+		},
+	}
+
+	for _, test := range tests {
+		var got []document
+		for _, doc := range splitDocuments([]byte(test.data)) {
+			got = append(got, *doc)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/pkg/runtime"
+)
+
+// NamespaceTemplate describes how namespaces created by the deployer are set up.
+type NamespaceTemplate struct {
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+	// Manifests is a file or folder with objects every namespace gets, like quotas, limit ranges and network policies.
+	Manifests string `yaml:"manifests,omitempty"`
+}
+
+// namespaceManifests renders the namespace template for the deploy namespace.
+// It returns nil if there is no template.
+func namespaceManifests(envMap map[string]string) ([]*Manifest, error) {
+	tmpl := config.NamespaceTemplate
+	if tmpl == nil {
+		return nil, nil
+	}
+
+	ns := namespaceObject(config.Namespace)
+	labels, err := renderValues(tmpl.Labels, envMap)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to render namespace template labels: %s", err)
+	}
+	if len(labels) > 0 {
+		ns.SetLabels(labels)
+	}
+	annotations, err := renderValues(tmpl.Annotations, envMap)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to render namespace template annotations: %s", err)
+	}
+	if len(annotations) > 0 {
+		ns.SetAnnotations(annotations)
+	}
+	source, err := yaml.Marshal(ns.Object)
+	if err != nil {
+		return nil, err
+	}
+	manifests := []*Manifest{{
+		File:   "namespaceTemplate",
+		Line:   1,
+		Source: source,
+		Object: ns,
+	}}
+
+	if tmpl.Manifests == "" {
+		return manifests, nil
+	}
+
+	files := []string{tmpl.Manifests}
+	info, err := os.Stat(tmpl.Manifests)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(tmpl.Manifests)
+		if err != nil {
+			return nil, err
+		}
+		files = nil
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(tmpl.Manifests, entry.Name()))
+			}
+		}
+	}
+
+	for _, file := range files {
+		rendered, err := renderManifests(file, "", "", config.Namespace, envMap)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, rendered...)
+	}
+
+	return manifests, nil
+}
+
+// ensureNamespace creates a namespace if it doesn't exist.
+func ensureNamespace(name string) error {
+	exists, err := kube.NamespaceExists(name)
+	if err != nil || exists {
+		return err
+	}
+
+	return kube.CreateNamespace(name)
+}
+
+// renderValues renders every value of a map with the variables in envMap.
+func renderValues(values map[string]string, envMap map[string]string) (map[string]string, error) {
+	rendered := make(map[string]string)
+	for key, value := range values {
+		out, err := renderTemplate(value, envMap)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		rendered[key] = string(out)
+	}
+
+	return rendered, nil
+}
+
+func namespaceObject(name string) *runtime.Unstructured {
+	return &runtime.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Namespace",
+			"metadata": map[string]interface{}{
+				"name": name,
+			},
+		},
+	}
+}
+
+// provisionNamespace creates the deploy namespace if it doesn't exist.
+// With a namespace template the namespace and its baseline objects are applied on every run,
+// so changes to the template reach existing namespaces too.
+func provisionNamespace(envMap map[string]string) error {
+	manifests, err := namespaceManifests(envMap)
+	if err != nil {
+		return err
+	}
+
+	exists, err := kube.NamespaceExists(config.Namespace)
+	if err != nil {
+		return err
+	}
+	if manifests == nil {
+		if exists {
+			return nil
+		}
+		return kube.CreateNamespace(config.Namespace)
+	}
+
+	// Remember that we created the namespace, so destroy can delete it as a whole.
+	// Once created the annotation is applied every time, or the apply would remove it again
+	created := !exists
+	if exists {
+		live, err := kube.Get(namespaceObject(config.Namespace))
+		if err != nil {
+			return err
+		}
+		created = live != nil && live.GetAnnotations()[createdAnnotation] == "true"
+	}
+	if created {
+		ns := manifests[0].Object
+		annotations := ns.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[createdAnnotation] = "true"
+		ns.SetAnnotations(annotations)
+	}
+
+	applied, err := kubeApply(stdLogger, manifests)
+	for _, result := range applied {
+		log.Println(result)
+	}
+
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/pkg/runtime"
+)
+
+// applyOrderAnnotation overrides where in the apply order an object goes. Lower numbers are applied first.
+const applyOrderAnnotation = "k8s-deployer/apply-order"
+
+// crdEstablishedTimeout is how long custom resources wait for their definition to be established.
+const crdEstablishedTimeout = time.Minute
+
+// kindOrder is the default apply order: namespaces, CRDs and RBAC first, then config, then workloads, then ingresses.
+var kindOrder = map[string]int{
+	"Namespace":                0,
+	"CustomResourceDefinition": 10,
+	"ThirdPartyResource":       10,
+	"PodSecurityPolicy":        20,
+	"ServiceAccount":           20,
+	"ClusterRole":              20,
+	"Role":                     20,
+	"ClusterRoleBinding":       25,
+	"RoleBinding":              25,
+	"ResourceQuota":            30,
+	"LimitRange":               30,
+	"NetworkPolicy":            30,
+	"ConfigMap":                40,
+	"Secret":                   40,
+	"StorageClass":             40,
+	"PersistentVolume":         40,
+	"PersistentVolumeClaim":    40,
+	"Service":                  50,
+	"Pod":                      60,
+	"ReplicationController":    60,
+	"ReplicaSet":               60,
+	"Deployment":               60,
+	"StatefulSet":              60,
+	"DaemonSet":                60,
+	"Job":                      60,
+	"CronJob":                  60,
+	"ScheduledJob":             60,
+	"HorizontalPodAutoscaler":  70,
+	"PodDisruptionBudget":      70,
+	"Ingress":                  80,
+}
+
+// defaultOrder is used for kinds not in kindOrder, like custom resources.
+const defaultOrder = 75
+
+type byApplyOrder []*Manifest
+
+func (o byApplyOrder) Len() int           { return len(o) }
+func (o byApplyOrder) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o byApplyOrder) Less(i, j int) bool { return applyOrder(o[i].Object) < applyOrder(o[j].Object) }
+
+// applyOrder returns the position of an object in the apply order.
+func applyOrder(obj *runtime.Unstructured) int {
+	if value, ok := obj.GetAnnotations()[applyOrderAnnotation]; ok {
+		if order, err := strconv.Atoi(value); err == nil {
+			return order
+		}
+	}
+
+	if order, ok := kindOrder[obj.GetKind()]; ok {
+		return order
+	}
+
+	return defaultOrder
+}
+
+// sortManifests sorts manifests in apply order, keeping the order they were rendered in within the same position.
+// Invalid apply order annotations are logged and ignored.
+func sortManifests(logger *log.Logger, manifests []*Manifest) {
+	for _, m := range manifests {
+		if value, ok := m.Object.GetAnnotations()[applyOrderAnnotation]; ok {
+			if _, err := strconv.Atoi(value); err != nil {
+				logger.Printf("Ignoring invalid %s annotation on %s %s: %s\n", applyOrderAnnotation, m.Object.GetKind(), m.Object.GetName(), value)
+			}
+		}
+	}
+	sort.Stable(byApplyOrder(manifests))
+}
+
+// crdKey identifies the custom resources a CRD defines by their group and kind.
+func crdKey(crd *runtime.Unstructured) string {
+	group, _ := nestedField(crd.Object, "spec", "group").(string)
+	kind, _ := nestedField(crd.Object, "spec", "names", "kind").(string)
+
+	return group + "/" + kind
+}
+
+// resourceKey returns the group and kind of an object, to be matched against crdKey.
+func resourceKey(obj *runtime.Unstructured) string {
+	group := ""
+	if i := strings.Index(obj.GetAPIVersion(), "/"); i >= 0 {
+		group = obj.GetAPIVersion()[:i]
+	}
+
+	return group + "/" + obj.GetKind()
+}
+
+// waitForEstablished waits until a CustomResourceDefinition is accepted by the API server.
+func waitForEstablished(logger *log.Logger, crd *runtime.Unstructured) error {
+	deadline := time.Now().Add(crdEstablishedTimeout)
+	for {
+		live, err := kube.Get(crd)
+		if err != nil {
+			return fmt.Errorf("Failed to get %s %s: %s", crd.GetKind(), crd.GetName(), err)
+		}
+		if live != nil {
+			if condition := findCondition(live, "Established"); condition != nil && condition["status"] == "True" {
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out after %s waiting for %s %s to be established", crdEstablishedTimeout, crd.GetKind(), crd.GetName())
+		}
+		logger.Printf("Waiting for %s/%s to be established\n", strings.ToLower(crd.GetKind()), crd.GetName())
+		time.Sleep(rolloutPollInterval)
+	}
+}
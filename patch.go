@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"k8s.io/client-go/pkg/runtime"
+)
+
+// lastAppliedAnnotation holds the configuration an object was last applied with.
+// It is the one kubectl apply uses, so objects deployed with kubectl before keep their history.
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// setLastApplied records the configuration of obj in its last applied annotation.
+func setLastApplied(obj *runtime.Unstructured) error {
+	annotations := obj.GetAnnotations()
+	delete(annotations, lastAppliedAnnotation)
+	if len(annotations) == 0 {
+		if metadata, ok := obj.Object["metadata"].(map[string]interface{}); ok {
+			delete(metadata, "annotations")
+		}
+		annotations = make(map[string]string)
+	} else {
+		obj.SetAnnotations(annotations)
+	}
+
+	applied, err := obj.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	annotations[lastAppliedAnnotation] = strings.TrimSpace(string(applied))
+	obj.SetAnnotations(annotations)
+
+	return nil
+}
+
+// applyPatch returns the JSON merge patch that turns live into obj.
+// Fields that were in the last applied configuration of live but are no longer in obj are removed,
+// fields that are set by others, like the status or defaults, are left alone.
+func applyPatch(obj, live *runtime.Unstructured) (map[string]interface{}, error) {
+	original := make(map[string]interface{})
+	if last := live.GetAnnotations()[lastAppliedAnnotation]; last != "" {
+		if err := json.Unmarshal([]byte(last), &original); err != nil {
+			original = make(map[string]interface{})
+		}
+	}
+	modified, err := jsonObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	current, err := jsonObject(live)
+	if err != nil {
+		return nil, err
+	}
+
+	return threeWayMergePatch(original, modified, current), nil
+}
+
+// jsonObject returns the fields of obj the way encoding/json decodes them, so values compare equal.
+func jsonObject(obj *runtime.Unstructured) (map[string]interface{}, error) {
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	err = json.Unmarshal(data, &fields)
+
+	return fields, err
+}
+
+// threeWayMergePatch sets the fields of modified that differ from current,
+// and deletes those that are in original but not in modified. Lists are replaced as a whole.
+func threeWayMergePatch(original, modified, current map[string]interface{}) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for key, value := range modified {
+		live, found := current[key]
+		if valueMap, ok := value.(map[string]interface{}); ok {
+			if liveMap, ok := live.(map[string]interface{}); ok {
+				originalMap, _ := original[key].(map[string]interface{})
+				if sub := threeWayMergePatch(originalMap, valueMap, liveMap); len(sub) > 0 {
+					patch[key] = sub
+				}
+				continue
+			}
+		}
+		if !found || !reflect.DeepEqual(live, value) {
+			patch[key] = value
+		}
+	}
+	for key := range original {
+		if _, kept := modified[key]; kept {
+			continue
+		}
+		if _, found := current[key]; found {
+			patch[key] = nil
+		}
+	}
+
+	return patch
+}
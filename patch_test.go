@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestThreeWayMergePatch(t *testing.T) {
+	tests := []struct {
+		name                        string
+		original, modified, current map[string]interface{}
+		want                        map[string]interface{}
+	}{
+		{
+			name:     "unchanged",
+			original: map[string]interface{}{"data": map[string]interface{}{"a": "1"}},
+			modified: map[string]interface{}{"data": map[string]interface{}{"a": "1"}},
+			current:  map[string]interface{}{"data": map[string]interface{}{"a": "1"}, "status": "x"},
+			want:     map[string]interface{}{},
+		},
+		{
+			name:     "changed value",
+			original: map[string]interface{}{"data": map[string]interface{}{"a": "1"}},
+			modified: map[string]interface{}{"data": map[string]interface{}{"a": "2"}},
+			current:  map[string]interface{}{"data": map[string]interface{}{"a": "1"}},
+			want:     map[string]interface{}{"data": map[string]interface{}{"a": "2"}},
+		},
+		{
+			name:     "removed key",
+			original: map[string]interface{}{"data": map[string]interface{}{"a": "1", "b": "2"}},
+			modified: map[string]interface{}{"data": map[string]interface{}{"a": "1"}},
+			current:  map[string]interface{}{"data": map[string]interface{}{"a": "1", "b": "2"}},
+			want:     map[string]interface{}{"data": map[string]interface{}{"b": nil}},
+		},
+		{
+			name:     "key set by others is kept",
+			original: map[string]interface{}{"data": map[string]interface{}{"a": "1"}},
+			modified: map[string]interface{}{"data": map[string]interface{}{"a": "1"}},
+			current:  map[string]interface{}{"data": map[string]interface{}{"a": "1", "c": "3"}},
+			want:     map[string]interface{}{},
+		},
+		{
+			name:     "removed key already gone",
+			original: map[string]interface{}{"spec": map[string]interface{}{"replicas": 2.0}},
+			modified: map[string]interface{}{"spec": map[string]interface{}{}},
+			current:  map[string]interface{}{"spec": map[string]interface{}{}},
+			want:     map[string]interface{}{},
+		},
+		{
+			name:     "no last applied configuration",
+			original: nil,
+			modified: map[string]interface{}{"data": map[string]interface{}{"a": "1"}},
+			current:  map[string]interface{}{"data": map[string]interface{}{"a": "1", "b": "2"}},
+			want:     map[string]interface{}{},
+		},
+		{
+			name:     "lists are replaced",
+			original: map[string]interface{}{"args": []interface{}{"a", "b"}},
+			modified: map[string]interface{}{"args": []interface{}{"a"}},
+			current:  map[string]interface{}{"args": []interface{}{"a", "b"}},
+			want:     map[string]interface{}{"args": []interface{}{"a"}},
+		},
+		{
+			name:     "map replaces other type",
+			original: map[string]interface{}{},
+			modified: map[string]interface{}{"x": map[string]interface{}{"a": "1"}},
+			current:  map[string]interface{}{"x": "scalar"},
+			want:     map[string]interface{}{"x": map[string]interface{}{"a": "1"}},
+		},
+	}
+
+	for _, test := range tests {
+		got := threeWayMergePatch(test.original, test.modified, test.current)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
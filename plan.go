@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"k8s.io/client-go/pkg/runtime"
+)
+
+// diffContext is the number of unchanged lines shown around a change.
+const diffContext = 3
+
+// PlanChange is what a deploy would do to a single object.
+type PlanChange struct {
+	Action string
+	Object *runtime.Unstructured
+	Diff   string
+}
+
+// Plan is the list of changes a deploy would make, without touching the cluster.
+type Plan struct {
+	Changes []*PlanChange
+	// crds are the custom resources defined by CRDs in the plan.
+	crds map[string]bool
+}
+
+// planDeploy renders every repository at the ref a deploy would use and compares it to the cluster.
+func planDeploy(repos []Repository, envMap map[string]string, updateRepo, updateRepoRef string) (*Plan, error) {
+	plan := &Plan{}
+
+	// The namespace and its baseline objects
+	namespaced, err := namespaceManifests(envMap)
+	if err != nil {
+		return nil, err
+	}
+	if err := plan.Add(namespaced); err != nil {
+		return nil, err
+	}
+
+	// k8s files in local repo
+	local, err := renderLocal(envMap)
+	if err != nil {
+		return nil, err
+	}
+	if err := plan.Add(local); err != nil {
+		return nil, err
+	}
+
+	for _, repo := range repos {
+		refName, oldRef, _, err := resolveRef(stdLogger, repo, statePath(repo), updateRepo, updateRepoRef)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve the ref of %s: %s", repo.URI, err)
+		}
+
+		ref, desired, err := renderRepository(stdLogger, repo, refName, envMap)
+		if err != nil {
+			return nil, fmt.Errorf("Failure while cloning files for %s: %s", repo.URI, err)
+		}
+		if err := plan.Add(desired); err != nil {
+			return nil, err
+		}
+
+		// Objects that only exist in the currently deployed ref are pruned, or left behind without prune.
+		// Uncommitted changes that were deployed before are gone, so they can't be compared
+		if _, dirty := splitDirtyRef(oldRef); oldRef == "" || oldRef == ref || dirty != "" {
+			continue
+		}
+		_, previous, err := renderRepository(stdLogger, repo, oldRef, envMap)
+		if err != nil {
+			return nil, fmt.Errorf("Failure while cloning files for %s: %s", repo.URI, err)
+		}
+		plan.Remove(manifestObjects(previous), manifestObjects(desired), repo.Prune)
+	}
+
+	return plan, nil
+}
+
+// Add compares the manifests to the live objects and records what applying them would change.
+func (p *Plan) Add(manifests []*Manifest) error {
+	if p.crds == nil {
+		p.crds = make(map[string]bool)
+	}
+	for _, m := range manifests {
+		if m.Object.GetKind() == "CustomResourceDefinition" {
+			p.crds[crdKey(m.Object)] = true
+		}
+	}
+
+	for _, m := range manifests {
+		obj := m.Object
+		resource, err := kube.mapping(obj)
+		if err != nil && !p.crds[resourceKey(obj)] {
+			return fmt.Errorf("%s: %s", m, err)
+		}
+		// Like Apply, only compare the namespace of resources that have one
+		if resource != nil && !resource.Namespaced {
+			obj.SetNamespace("")
+		}
+
+		// The API server doesn't know custom resources whose CRD is only created by the deploy
+		var live *runtime.Unstructured
+		if resource != nil {
+			live, err = kube.Get(obj)
+			if err != nil {
+				return fmt.Errorf("%s: %s", m, err)
+			}
+		}
+
+		desiredYAML, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return err
+		}
+
+		if live == nil {
+			p.Changes = append(p.Changes, &PlanChange{
+				Action: "created",
+				Object: obj,
+				Diff:   unifiedDiff("", string(desiredYAML)),
+			})
+			continue
+		}
+
+		// Only compare the fields we set, the server fills in status and defaults
+		liveYAML, err := yaml.Marshal(projectOnto(live.Object, obj.Object))
+		if err != nil {
+			return err
+		}
+
+		change := &PlanChange{
+			Action: "unchanged",
+			Object: obj,
+		}
+		if string(liveYAML) != string(desiredYAML) {
+			change.Action = "changed"
+			change.Diff = unifiedDiff(string(liveYAML), string(desiredYAML))
+		}
+		p.Changes = append(p.Changes, change)
+	}
+
+	return nil
+}
+
+// Remove records the objects in previous that are not in current,
+// as removed if they are pruned and as left behind otherwise.
+func (p *Plan) Remove(previous, current []*runtime.Unstructured, prune bool) {
+	keep := make(map[string]bool)
+	for _, obj := range current {
+		keep[objectKey(obj)] = true
+	}
+
+	for _, obj := range previous {
+		// Cluster-scoped objects in current had their namespace cleared by Add
+		if resource, err := kube.mapping(obj); err == nil && !resource.Namespaced {
+			obj.SetNamespace("")
+		}
+		if keep[objectKey(obj)] {
+			continue
+		}
+		if !prune {
+			p.Changes = append(p.Changes, &PlanChange{
+				Action: "left behind",
+				Object: obj,
+			})
+			continue
+		}
+		previousYAML, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			continue
+		}
+		p.Changes = append(p.Changes, &PlanChange{
+			Action: "removed",
+			Object: obj,
+			Diff:   unifiedDiff(string(previousYAML), ""),
+		})
+	}
+}
+
+// Count returns the number of changes with the given action.
+func (p *Plan) Count(action string) int {
+	count := 0
+	for _, change := range p.Changes {
+		if change.Action == action {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (p *Plan) Print(w io.Writer) {
+	for _, change := range p.Changes {
+		fmt.Fprintf(w, "%s/%s (namespace %s) %s\n", strings.ToLower(change.Object.GetKind()), change.Object.GetName(), change.Object.GetNamespace(), change.Action)
+		if change.Diff != "" {
+			fmt.Fprint(w, change.Diff)
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d created, %d changed, %d unchanged, %d removed, %d left behind\n",
+		p.Count("created"), p.Count("changed"), p.Count("unchanged"), p.Count("removed"), p.Count("left behind"))
+}
+
+// projectOnto returns the parts of live that are also set in desired.
+func projectOnto(live, desired interface{}) interface{} {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return live
+		}
+		out := make(map[string]interface{})
+		for key, value := range d {
+			if liveValue, found := l[key]; found {
+				out[key] = projectOnto(liveValue, value)
+			}
+		}
+		return out
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			return live
+		}
+		out := make([]interface{}, len(l))
+		for i := range l {
+			out[i] = projectOnto(l[i], d[i])
+		}
+		return out
+	}
+
+	return live
+}
+
+// unifiedDiff returns a line diff of from and to with a few lines of context around each change.
+func unifiedDiff(from, to string) string {
+	dmp := diffmatchpatch.New()
+	a, b, lineArray := dmp.DiffLinesToChars(from, to)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(a, b, false), lineArray)
+
+	type diffLine struct {
+		op   diffmatchpatch.Operation
+		text string
+	}
+	var lines []diffLine
+	for _, d := range diffs {
+		for _, line := range strings.SplitAfter(d.Text, "\n") {
+			if line == "" {
+				continue
+			}
+			lines = append(lines, diffLine{d.Type, strings.TrimSuffix(line, "\n")})
+		}
+	}
+
+	// Mark the lines that are close enough to a change to be shown
+	show := make([]bool, len(lines))
+	for i, line := range lines {
+		if line.op == diffmatchpatch.DiffEqual {
+			continue
+		}
+		for j := i - diffContext; j <= i+diffContext; j++ {
+			if j >= 0 && j < len(lines) {
+				show[j] = true
+			}
+		}
+	}
+
+	var out []string
+	for i, line := range lines {
+		if !show[i] {
+			continue
+		}
+		if i == 0 || !show[i-1] {
+			out = append(out, "@@")
+		}
+		switch line.op {
+		case diffmatchpatch.DiffInsert:
+			out = append(out, "+"+line.text)
+		case diffmatchpatch.DiffDelete:
+			out = append(out, "-"+line.text)
+		default:
+			out = append(out, " "+line.text)
+		}
+	}
+	if len(out) == 0 {
+		return ""
+	}
+
+	return strings.Join(out, "\n") + "\n"
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"time"
+)
+
+// Provenance labels and annotations, telling where an applied object came from.
+const (
+	commitLabel          = "k8s-deployer/commit"
+	commitAnnotation     = "k8s-deployer/commit"
+	uriAnnotation        = "k8s-deployer/uri"
+	versionAnnotation    = "k8s-deployer/version"
+	deployedAtAnnotation = "k8s-deployer/deployed-at"
+)
+
+// podTemplateKinds are the workloads whose pod template gets the provenance too.
+// Jobs are left out since their template can't be changed once created.
+var podTemplateKinds = map[string]bool{
+	"Deployment":            true,
+	"StatefulSet":           true,
+	"DaemonSet":             true,
+	"ReplicaSet":            true,
+	"ReplicationController": true,
+}
+
+// addProvenance labels and annotates the object of a manifest with its repository, commit,
+// the deployer version and the time of the deploy, right before it is applied.
+// The pod templates of workloads only get the ownership labels and the commit, as an annotation:
+// a commit label there could end up in a defaulted selector, which can't be changed later,
+// and any other change to the template, like the deploy time, would restart the pods.
+func addProvenance(m *Manifest, deployedAt time.Time) {
+	obj := m.Object
+
+	annotations := map[string]string{
+		versionAnnotation:    version,
+		deployedAtAnnotation: deployedAt.UTC().Format(time.RFC3339),
+	}
+	if m.URI != "" {
+		annotations[uriAnnotation] = m.URI
+	}
+	setAnnotations(obj.Object, annotations)
+
+	labels := make(map[string]string)
+	for _, key := range []string{repositoryLabel, namespaceLabel} {
+		if value, ok := obj.GetLabels()[key]; ok {
+			labels[key] = value
+		}
+	}
+	if podTemplateKinds[obj.GetKind()] {
+		if template, ok := nestedField(obj.Object, "spec", "template").(map[string]interface{}); ok {
+			setLabels(template, labels)
+			if m.Commit != "" {
+				setAnnotations(template, map[string]string{commitAnnotation: m.Commit})
+			}
+		}
+	}
+
+	if m.Commit != "" {
+		labels[commitLabel] = labelValue(m.Commit)
+	}
+	setLabels(obj.Object, labels)
+}
+
+func setLabels(obj map[string]interface{}, labels map[string]string) {
+	setMetadataField(obj, "labels", labels)
+}
+
+func setAnnotations(obj map[string]interface{}, annotations map[string]string) {
+	setMetadataField(obj, "annotations", annotations)
+}
+
+// setMetadataField adds values to a string map under metadata, keeping what is already there.
+func setMetadataField(obj map[string]interface{}, field string, values map[string]string) {
+	if len(values) == 0 {
+		return
+	}
+
+	metadata, ok := obj["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = make(map[string]interface{})
+		obj["metadata"] = metadata
+	}
+	m, ok := metadata[field].(map[string]interface{})
+	if !ok {
+		m = make(map[string]interface{})
+		metadata[field] = m
+	}
+	for key, value := range values {
+		m[key] = value
+	}
+}
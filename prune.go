@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/pkg/runtime"
+)
+
+// ownerSelector returns the label selector for the objects a repository owns in the deploy namespace.
+func ownerSelector(owner string) string {
+	return fmt.Sprintf("%s=%s,%s=%s", repositoryLabel, labelValue(owner), namespaceLabel, labelValue(config.Namespace))
+}
+
+// checkOwners makes sure a repository that prunes is the only one labeled as its owner in its namespace,
+// the objects of a repository or local repo with the same name would be pruned with it.
+func checkOwners(repos []Repository) error {
+	owners := make(map[string]int)
+	if config.KubeFolder != "" && config.KubeFolder != "<no value>" {
+		name, err := localRepoName()
+		if err != nil {
+			return err
+		}
+		owners[labelValue(name)+" "+config.Namespace]++
+	}
+	for _, repo := range repos {
+		owners[labelValue(repositoryName(repo))+" "+repositoryNamespace(repo)]++
+	}
+
+	for _, repo := range repos {
+		if repo.Prune && owners[labelValue(repositoryName(repo))+" "+repositoryNamespace(repo)] > 1 {
+			return fmt.Errorf("Repository %s is pruned, but another repository or the local repo in namespace %s has the same name, give it a unique name", repositoryName(repo), repositoryNamespace(repo))
+		}
+	}
+
+	return nil
+}
+
+// ownedObjects lists the objects in namespace matching selector that the deployer manages itself.
+// Objects created by a controller are left out: those with an owner, like the pods of a deployment,
+// and Endpoints, which the endpoints controller labels like their Service.
+func ownedObjects(namespace, selector string) ([]*runtime.Unstructured, error) {
+	listed, err := kube.List(namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var owned []*runtime.Unstructured
+	seen := make(map[string]bool)
+	for _, obj := range listed {
+		if len(obj.GetOwnerReferences()) > 0 || obj.GetKind() == "Endpoints" {
+			continue
+		}
+		// The same object can be listed through more than one API group
+		if seen[objectKey(obj)] {
+			continue
+		}
+		seen[objectKey(obj)] = true
+		owned = append(owned, obj)
+	}
+
+	return owned, nil
+}
+
+// pruneRepository deletes the objects owned by a repository in namespace that were not part of what was just applied.
+// Only namespaced objects are pruned.
+func pruneRepository(owner, namespace string, applied []*ApplyResult) ([]*ApplyResult, error) {
+	keep := make(map[string]bool)
+	for _, result := range applied {
+		keep[objectKey(result.Object)] = true
+	}
+
+	owned, err := ownedObjects(namespace, ownerSelector(owner))
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []*ApplyResult
+	for _, obj := range owned {
+		if keep[objectKey(obj)] {
+			continue
+		}
+
+		if err := kube.Delete(obj); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, &ApplyResult{
+			Kind:      obj.GetKind(),
+			Name:      obj.GetName(),
+			Namespace: obj.GetNamespace(),
+			Action:    "pruned",
+			Object:    obj,
+		})
+	}
+
+	return pruned, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/idxfile"
+)
+
+var hexRef = regexp.MustCompile(`^[0-9a-fA-F]{4,40}$`)
+
+// resolveCommit finds the commit a ref points to in the cached repository at path.
+// A ref is a full ref name, a tag, a branch on origin, or a full or abbreviated commit hash.
+// Annotated tags are resolved to the commit they tag.
+func resolveCommit(repo *git.Repository, path, refName string) (*git.Commit, error) {
+	if strings.HasPrefix(refName, "refs/") {
+		name := refName
+		if strings.HasPrefix(name, "refs/heads/") {
+			// The cache is a mirror, the branches of the remote are kept under origin
+			name = "refs/remotes/origin/" + strings.TrimPrefix(name, "refs/heads/")
+		}
+		ref, err := repo.Ref(plumbing.ReferenceName(name), true)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown ref %s", refName)
+		}
+
+		return peelCommit(repo, ref.Hash())
+	}
+
+	if len(refName) == 40 && hexRef.MatchString(refName) {
+		commit, err := peelCommit(repo, plumbing.NewHash(refName))
+		if err != nil {
+			return nil, fmt.Errorf("Unknown commit %s: %s", refName, err)
+		}
+
+		return commit, nil
+	}
+
+	candidates := make(map[plumbing.Hash][]string)
+	names := []string{"refs/tags/" + refName, "refs/remotes/origin/" + refName}
+	if strings.HasPrefix(refName, "origin/") {
+		names = append(names, "refs/remotes/"+refName)
+	}
+	for _, name := range names {
+		ref, err := repo.Ref(plumbing.ReferenceName(name), true)
+		if err != nil {
+			continue
+		}
+		commit, err := peelCommit(repo, ref.Hash())
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve %s: %s", name, err)
+		}
+		candidates[commit.Hash] = append(candidates[commit.Hash], name)
+	}
+
+	if hexRef.MatchString(refName) {
+		hashes, err := objectsWithPrefix(path, strings.ToLower(refName))
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hashes {
+			// Only commits and tags can be deployed, other objects sharing the prefix are ignored
+			commit, err := peelCommit(repo, h)
+			if err != nil {
+				continue
+			}
+			candidates[commit.Hash] = append(candidates[commit.Hash], "commit "+h.String())
+		}
+	}
+
+	h, err := singleCandidate(refName, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.Commit(h)
+}
+
+// singleCandidate returns the only commit a ref can mean, or an error naming all of them.
+// The candidates map commits to the names that matched them.
+func singleCandidate(refName string, candidates map[plumbing.Hash][]string) (plumbing.Hash, error) {
+	switch len(candidates) {
+	case 0:
+		return plumbing.ZeroHash, fmt.Errorf("Unknown ref %s: no tag, branch or commit with that name", refName)
+	case 1:
+		for h := range candidates {
+			return h, nil
+		}
+	}
+
+	var matches []string
+	for h, names := range candidates {
+		matches = append(matches, fmt.Sprintf("%s (%s)", h, strings.Join(names, ", ")))
+	}
+	sort.Strings(matches)
+
+	return plumbing.ZeroHash, fmt.Errorf("Ambiguous ref %s, it matches %s", refName, strings.Join(matches, "; "))
+}
+
+// peelCommit returns the commit of a hash, following annotated tags.
+func peelCommit(repo *git.Repository, h plumbing.Hash) (*git.Commit, error) {
+	for {
+		obj, err := repo.Object(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, err
+		}
+		switch o := obj.(type) {
+		case *git.Commit:
+			return o, nil
+		case *git.Tag:
+			h = o.Target
+		default:
+			return nil, fmt.Errorf("%s is a %s, not a commit", h, obj.Type())
+		}
+	}
+}
+
+// objectsWithPrefix lists the objects in the repository at path whose hash starts with prefix.
+// It reads the pack indexes and loose object names, so no objects are decoded.
+func objectsWithPrefix(path, prefix string) ([]plumbing.Hash, error) {
+	var hashes []plumbing.Hash
+
+	idxFiles, err := filepath.Glob(filepath.Join(path, "objects", "pack", "*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range idxFiles {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		idx := &idxfile.Idxfile{}
+		err = idxfile.NewDecoder(file).Decode(idx)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read pack index %s: %s", name, err)
+		}
+		for _, e := range idx.Entries {
+			if strings.HasPrefix(e.Hash.String(), prefix) {
+				hashes = append(hashes, e.Hash)
+			}
+		}
+	}
+
+	loose, err := ioutil.ReadDir(filepath.Join(path, "objects", prefix[:2]))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, f := range loose {
+		if name := prefix[:2] + f.Name(); len(name) == 40 && strings.HasPrefix(name, prefix) {
+			hashes = append(hashes, plumbing.NewHash(name))
+		}
+	}
+
+	return hashes, nil
+}
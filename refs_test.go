@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestSingleCandidate(t *testing.T) {
+	a := plumbing.NewHash("1111111111111111111111111111111111111111")
+	b := plumbing.NewHash("2222222222222222222222222222222222222222")
+
+	tests := []struct {
+		name       string
+		candidates map[plumbing.Hash][]string
+		want       plumbing.Hash
+		err        string
+	}{
+		{
+			name:       "none",
+			candidates: map[plumbing.Hash][]string{},
+			err:        "Unknown ref v1: no tag, branch or commit with that name",
+		},
+		{
+			name:       "one",
+			candidates: map[plumbing.Hash][]string{a: {"refs/tags/v1"}},
+			want:       a,
+		},
+		{
+			name:       "names of the same commit",
+			candidates: map[plumbing.Hash][]string{a: {"refs/tags/v1", "refs/heads/v1"}},
+			want:       a,
+		},
+		{
+			name:       "different commits",
+			candidates: map[plumbing.Hash][]string{b: {"refs/heads/v1"}, a: {"refs/tags/v1"}},
+			err:        "Ambiguous ref v1, it matches " + a.String() + " (refs/tags/v1); " + b.String() + " (refs/heads/v1)",
+		},
+	}
+
+	for _, test := range tests {
+		got, err := singleCandidate("v1", test.candidates)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/blang/semver"
+)
+
+// Release is the tag picked for a repository that follows a version constraint.
+type Release struct {
+	Tag            string
+	Commit         string
+	PreviousTag    string
+	PreviousCommit string
+}
+
+// versionRange is a parsed version constraint like "~1.4" or ">=2.0.0 <3 || 3.1.x".
+type versionRange struct {
+	alternatives [][]func(semver.Version) bool
+	// Pre-release tags are only picked if the constraint names a pre-release
+	allowPre bool
+}
+
+func parseVersionRange(constraint string) (*versionRange, error) {
+	r := &versionRange{}
+	for _, alternative := range strings.Split(constraint, "||") {
+		var comparators []func(semver.Version) bool
+		fields := strings.Fields(strings.Replace(alternative, ",", " ", -1))
+		for i := 0; i < len(fields); i++ {
+			field := fields[i]
+			// Allow a space between the operator and the version, like ">= 2.0.0"
+			if strings.Trim(field, "<>=!~^") == "" && i+1 < len(fields) {
+				i++
+				field += fields[i]
+			}
+			cmp, pre, err := parseComparator(field)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid version constraint %q: %s", constraint, err)
+			}
+			comparators = append(comparators, cmp...)
+			r.allowPre = r.allowPre || pre
+		}
+		if len(comparators) == 0 {
+			return nil, fmt.Errorf("Invalid version constraint %q: empty range", constraint)
+		}
+		r.alternatives = append(r.alternatives, comparators)
+	}
+
+	return r, nil
+}
+
+// Contains reports whether v satisfies the constraint.
+func (r *versionRange) Contains(v semver.Version) bool {
+	if len(v.Pre) > 0 && !r.allowPre {
+		return false
+	}
+	for _, comparators := range r.alternatives {
+		ok := true
+		for _, cmp := range comparators {
+			if !cmp(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseComparator parses one operator and version. Partial versions like "1.4" or "1.4.x" stand for all versions they prefix.
+func parseComparator(s string) ([]func(semver.Version) bool, bool, error) {
+	op := s[:len(s)-len(strings.TrimLeft(s, "<>=!~^"))]
+	lower, parts, err := parsePartialVersion(strings.TrimPrefix(s[len(op):], "v"))
+	if err != nil {
+		return nil, false, err
+	}
+	pre := len(lower.Pre) > 0
+
+	// upper is the first version after the ones the partial version stands for
+	upper := lower
+	upper.Pre = nil
+	switch parts {
+	case 1:
+		upper = semver.Version{Major: lower.Major + 1}
+	case 2:
+		upper = semver.Version{Major: lower.Major, Minor: lower.Minor + 1}
+	}
+
+	atLeast := func(v semver.Version) bool { return v.GTE(lower) }
+	below := func(v semver.Version) bool { return v.LT(upper) }
+	if parts == 0 {
+		atLeast = func(v semver.Version) bool { return true }
+		below = atLeast
+	}
+
+	switch op {
+	case "", "=":
+		if parts == 3 {
+			return []func(semver.Version) bool{func(v semver.Version) bool { return v.EQ(lower) }}, pre, nil
+		}
+		return []func(semver.Version) bool{atLeast, below}, pre, nil
+	case "!=":
+		if parts == 3 {
+			return []func(semver.Version) bool{func(v semver.Version) bool { return v.NE(lower) }}, pre, nil
+		}
+		return []func(semver.Version) bool{func(v semver.Version) bool { return !atLeast(v) || !below(v) }}, pre, nil
+	case ">=":
+		return []func(semver.Version) bool{atLeast}, pre, nil
+	case ">":
+		if parts == 3 {
+			return []func(semver.Version) bool{func(v semver.Version) bool { return v.GT(lower) }}, pre, nil
+		}
+		return []func(semver.Version) bool{func(v semver.Version) bool { return parts != 0 && v.GTE(upper) }}, pre, nil
+	case "<":
+		return []func(semver.Version) bool{func(v semver.Version) bool { return parts != 0 && v.LT(lower) }}, pre, nil
+	case "<=":
+		if parts == 3 {
+			return []func(semver.Version) bool{func(v semver.Version) bool { return v.LTE(lower) }}, pre, nil
+		}
+		return []func(semver.Version) bool{below}, pre, nil
+	case "~":
+		// ~1.4.2 and ~1.4 allow patch updates, ~1 allows minor updates
+		if parts == 3 {
+			upper = semver.Version{Major: lower.Major, Minor: lower.Minor + 1}
+		}
+		return []func(semver.Version) bool{atLeast, func(v semver.Version) bool { return v.LT(upper) }}, pre, nil
+	case "^":
+		// ^1.4.2 allows everything up to the next major version, or the next minor version for 0.x
+		switch {
+		case lower.Major > 0 || parts == 1:
+			upper = semver.Version{Major: lower.Major + 1}
+		case lower.Minor > 0 || parts == 2:
+			upper = semver.Version{Minor: lower.Minor + 1}
+		default:
+			upper = semver.Version{Patch: lower.Patch + 1}
+		}
+		return []func(semver.Version) bool{atLeast, func(v semver.Version) bool { return v.LT(upper) }}, pre, nil
+	}
+
+	return nil, false, fmt.Errorf("unknown operator %q", op)
+}
+
+// parsePartialVersion parses a version of which the minor and patch numbers may be left out or be "x".
+// It returns the lowest version it stands for and how many numbers were given.
+func parsePartialVersion(s string) (semver.Version, int, error) {
+	if s == "" || s == "*" || s == "x" || s == "X" {
+		return semver.Version{}, 0, nil
+	}
+	if strings.Count(s, ".") >= 2 && !strings.ContainsAny(strings.SplitN(s, ".", 3)[2], "xX*") {
+		v, err := semver.Parse(s)
+		return v, 3, err
+	}
+
+	var numbers []uint64
+	for _, part := range strings.Split(s, ".") {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return semver.Version{}, 0, fmt.Errorf("invalid version %q", s)
+		}
+		numbers = append(numbers, n)
+	}
+	v := semver.Version{}
+	if len(numbers) > 0 {
+		v.Major = numbers[0]
+	}
+	if len(numbers) > 1 {
+		v.Minor = numbers[1]
+	}
+	if len(numbers) > 2 {
+		v.Patch = numbers[2]
+	}
+
+	return v, len(numbers), nil
+}
+
+// tagVersion parses a tag name like "v1.4.2" or "1.4.2".
+func tagVersion(tag string) (semver.Version, bool) {
+	v, err := semver.Parse(strings.TrimPrefix(tag, "v"))
+	return v, err == nil
+}
+
+// selectRelease picks the highest tag of a repository that satisfies the constraint.
+// The tags are read from the remote, annotated tags with the commit they point to, so nothing is fetched.
+// The previously deployed commit is reported with its highest version tag, if it has one.
+func selectRelease(uri, constraint, oldRef string) (*Release, error) {
+	versions, err := parseVersionRange(constraint)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := connectRemote(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Disconnect()
+	ar, err := remote.advertisedRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	release := &Release{PreviousCommit: oldRef}
+	var best, previous semver.Version
+	for name, h := range ar.References {
+		if !strings.HasPrefix(name, "refs/tags/") {
+			continue
+		}
+		tag := strings.TrimPrefix(name, "refs/tags/")
+		v, ok := tagVersion(tag)
+		if !ok {
+			continue
+		}
+		commit := h
+		if peeled, ok := ar.Peeled[name]; ok {
+			commit = peeled
+		}
+		if versions.Contains(v) && (release.Tag == "" || v.GT(best) || (v.EQ(best) && tag < release.Tag)) {
+			release.Tag, release.Commit, best = tag, commit.String(), v
+		}
+		if oldRef != "" && commit.String() == oldRef && (release.PreviousTag == "" || v.GT(previous)) {
+			release.PreviousTag, previous = tag, v
+		}
+	}
+	if release.Tag == "" {
+		return nil, fmt.Errorf("No tag of %s matches version %s", uri, constraint)
+	}
+
+	return release, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+func TestParseVersionRange(t *testing.T) {
+	tests := []struct {
+		constraint string
+		contains   []string
+		excludes   []string
+		invalid    bool
+	}{
+		{constraint: "1.4.2", contains: []string{"1.4.2"}, excludes: []string{"1.4.3", "1.4.1"}},
+		{constraint: "1.4", contains: []string{"1.4.0", "1.4.9"}, excludes: []string{"1.5.0", "1.3.9"}},
+		{constraint: "1.x", contains: []string{"1.0.0", "1.9.9"}, excludes: []string{"2.0.0", "0.9.0"}},
+		{constraint: "*", contains: []string{"0.0.1", "9.9.9"}},
+		{constraint: "~1.4.2", contains: []string{"1.4.2", "1.4.9"}, excludes: []string{"1.5.0", "1.4.1"}},
+		{constraint: "~1", contains: []string{"1.0.0", "1.9.0"}, excludes: []string{"2.0.0"}},
+		{constraint: "^1.4.2", contains: []string{"1.4.2", "1.9.0"}, excludes: []string{"2.0.0", "1.4.1"}},
+		{constraint: "^0.4.2", contains: []string{"0.4.2", "0.4.9"}, excludes: []string{"0.5.0"}},
+		{constraint: "^0.0.3", contains: []string{"0.0.3"}, excludes: []string{"0.0.4"}},
+		{constraint: ">=2.0.0 <3", contains: []string{"2.0.0", "2.9.9"}, excludes: []string{"3.0.0", "1.9.9"}},
+		{constraint: ">= 2.0.0, < 3", contains: []string{"2.5.0"}, excludes: []string{"3.0.0"}},
+		{constraint: ">1.4", contains: []string{"1.5.0"}, excludes: []string{"1.4.9"}},
+		{constraint: "<=1.4", contains: []string{"1.4.9"}, excludes: []string{"1.5.0"}},
+		{constraint: "!=1.4.2", contains: []string{"1.4.1", "1.4.3"}, excludes: []string{"1.4.2"}},
+		{constraint: "<2 || 3.1.x", contains: []string{"1.9.0", "3.1.4"}, excludes: []string{"2.0.0", "3.2.0"}},
+		{constraint: "v1.4", contains: []string{"1.4.1"}},
+		{constraint: "~1.4", excludes: []string{"1.4.1-rc.1"}},
+		{constraint: ">=1.4.1-rc.1", contains: []string{"1.4.1-rc.2", "1.4.1"}},
+		{constraint: "", invalid: true},
+		{constraint: "1.4 ||", invalid: true},
+		{constraint: "=>1.4", invalid: true},
+		{constraint: "1.a", invalid: true},
+	}
+
+	for _, test := range tests {
+		r, err := parseVersionRange(test.constraint)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.constraint)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.constraint, err)
+			continue
+		}
+		for _, v := range test.contains {
+			if !r.Contains(semver.MustParse(v)) {
+				t.Errorf("%q should contain %s", test.constraint, v)
+			}
+		}
+		for _, v := range test.excludes {
+			if r.Contains(semver.MustParse(v)) {
+				t.Errorf("%q should not contain %s", test.constraint, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/pkg/runtime"
+)
+
+// rolloutPollInterval is how often the status of workloads is checked while waiting.
+const rolloutPollInterval = 2 * time.Second
+
+// waitForRollout waits until every Deployment, StatefulSet, DaemonSet and Job in results is ready or complete.
+func waitForRollout(logger *log.Logger, results []*ApplyResult, timeout time.Duration) error {
+	var pending []*runtime.Unstructured
+	for _, result := range results {
+		switch result.Kind {
+		case "Deployment", "StatefulSet", "DaemonSet", "Job":
+			pending = append(pending, result.Object)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for len(pending) > 0 {
+		var waiting []*runtime.Unstructured
+		for _, obj := range pending {
+			live, err := kube.Get(obj)
+			if err != nil {
+				return fmt.Errorf("Failed to get %s %s: %s", obj.GetKind(), obj.GetName(), err)
+			}
+			if live == nil {
+				return fmt.Errorf("%s %s disappeared while waiting for it to become ready", obj.GetKind(), obj.GetName())
+			}
+
+			ready, message, err := rolloutStatus(live)
+			if err != nil {
+				return fmt.Errorf("%s %s failed: %s", obj.GetKind(), obj.GetName(), err)
+			}
+			if !ready {
+				logger.Printf("Waiting for %s/%s: %s\n", strings.ToLower(obj.GetKind()), obj.GetName(), message)
+				waiting = append(waiting, obj)
+			}
+		}
+		pending = waiting
+		if len(pending) == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			var names []string
+			for _, obj := range pending {
+				names = append(names, strings.ToLower(obj.GetKind())+"/"+obj.GetName())
+			}
+			return fmt.Errorf("Timed out after %s waiting for %s", timeout, strings.Join(names, ", "))
+		}
+		time.Sleep(rolloutPollInterval)
+	}
+
+	return nil
+}
+
+// rolloutStatus tells if a workload is ready. An error is returned if it can never become ready.
+func rolloutStatus(obj *runtime.Unstructured) (bool, string, error) {
+	generation, _ := nestedInt(obj.Object, "metadata", "generation")
+	observed, hasObserved := nestedInt(obj.Object, "status", "observedGeneration")
+	if hasObserved && observed < generation {
+		return false, "waiting for the update to be observed", nil
+	}
+
+	switch obj.GetKind() {
+	case "Deployment":
+		if condition := findCondition(obj, "Progressing"); condition != nil && condition["reason"] == "ProgressDeadlineExceeded" {
+			return false, "", fmt.Errorf("%v", condition["message"])
+		}
+		replicas := specReplicas(obj)
+		updated, _ := nestedInt(obj.Object, "status", "updatedReplicas")
+		available, _ := nestedInt(obj.Object, "status", "availableReplicas")
+		total, _ := nestedInt(obj.Object, "status", "replicas")
+		if updated < replicas {
+			return false, fmt.Sprintf("%d of %d updated replicas", updated, replicas), nil
+		}
+		if total > updated {
+			return false, fmt.Sprintf("%d old replicas pending termination", total-updated), nil
+		}
+		if available < updated {
+			return false, fmt.Sprintf("%d of %d updated replicas available", available, updated), nil
+		}
+	case "StatefulSet":
+		replicas := specReplicas(obj)
+		ready, found := nestedInt(obj.Object, "status", "readyReplicas")
+		if !found {
+			// Older API servers only report the number of created replicas
+			ready, _ = nestedInt(obj.Object, "status", "replicas")
+		}
+		if ready < replicas {
+			return false, fmt.Sprintf("%d of %d replicas ready", ready, replicas), nil
+		}
+	case "DaemonSet":
+		desired, _ := nestedInt(obj.Object, "status", "desiredNumberScheduled")
+		ready, _ := nestedInt(obj.Object, "status", "numberReady")
+		if updated, found := nestedInt(obj.Object, "status", "updatedNumberScheduled"); found && updated < desired {
+			return false, fmt.Sprintf("%d of %d updated pods scheduled", updated, desired), nil
+		}
+		if ready < desired {
+			return false, fmt.Sprintf("%d of %d pods ready", ready, desired), nil
+		}
+	case "Job":
+		if condition := findCondition(obj, "Failed"); condition != nil && condition["status"] == "True" {
+			return false, "", fmt.Errorf("%v", condition["message"])
+		}
+		completions, found := nestedInt(obj.Object, "spec", "completions")
+		if !found {
+			completions = 1
+		}
+		succeeded, _ := nestedInt(obj.Object, "status", "succeeded")
+		if succeeded < completions {
+			return false, fmt.Sprintf("%d of %d completions", succeeded, completions), nil
+		}
+	}
+
+	return true, "", nil
+}
+
+func specReplicas(obj *runtime.Unstructured) int64 {
+	replicas, found := nestedInt(obj.Object, "spec", "replicas")
+	if !found {
+		return 1
+	}
+
+	return replicas
+}
+
+// findCondition returns the status condition of the given type, or nil.
+func findCondition(obj *runtime.Unstructured, conditionType string) map[string]interface{} {
+	conditions, _ := nestedField(obj.Object, "status", "conditions").([]interface{})
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if ok && condition["type"] == conditionType {
+			return condition
+		}
+	}
+
+	return nil
+}
+
+func nestedField(obj map[string]interface{}, fields ...string) interface{} {
+	var val interface{} = obj
+	for _, field := range fields {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		val = m[field]
+	}
+
+	return val
+}
+
+func nestedInt(obj map[string]interface{}, fields ...string) (int64, bool) {
+	switch v := nestedField(obj, fields...).(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	}
+
+	return 0, false
+}
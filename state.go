@@ -10,7 +10,28 @@ import (
 type State interface {
 	Get(key string) (string, error)
 	Set(key, value string) error
-	Clear(namespace string) error
+	Clear(prefix string) error
+}
+
+// statePrefix returns the prefix the state of a namespace is kept under.
+// The default target keeps the original layout, other targets get their own prefix.
+func statePrefix(target, namespace string) string {
+	if target == "" {
+		return "k8s-deployer/" + namespace
+	}
+
+	return fmt.Sprintf("k8s-deployer@%s/%s", target, namespace)
+}
+
+// statePath returns the state key of a repository in the current target and namespace.
+// Components are kept under the URI of their repository followed by #name.
+func statePath(repo Repository) string {
+	key := statePrefix(currentTarget, config.Namespace) + "/" + repo.URI
+	if repo.Component != "" {
+		key += "#" + repo.Component
+	}
+
+	return key
 }
 
 type RedisState struct {
@@ -44,8 +65,8 @@ func (r *RedisState) Get(key string) (string, error) {
 	return res.Val(), res.Err()
 }
 
-func (r *RedisState) Clear(namespace string) error {
-	keysCmd := r.client.Keys(fmt.Sprintf("k8s-deployer/%s/*", namespace))
+func (r *RedisState) Clear(prefix string) error {
+	keysCmd := r.client.Keys(prefix + "/*")
 	keys, err := keysCmd.Result()
 	if err != nil {
 		return err
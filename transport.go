@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/client"
+	"gopkg.in/src-d/go-git.v4/plumbing/client/common"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packp/advrefs"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packp/pktline"
+)
+
+// The upload-pack clients bundled with go-git send the haves in the wrong place
+// and only understand a NAK as the answer, so every fetch that tells the server
+// which objects we already have fails.
+// These replace them for every repository.
+func init() {
+	clients.InstallProtocol("http", newHTTPUploadPack)
+	clients.InstallProtocol("https", newHTTPUploadPack)
+	clients.InstallProtocol("ssh", newSSHUploadPack)
+}
+
+// uploadPack is implemented by the upload-pack clients in this file.
+// Besides what go-git needs it gives the refs as advertised, with the commits tags point to,
+// and fetches with capabilities like filters.
+type uploadPack interface {
+	common.GitUploadPackService
+	advertisedRefs() (*advrefs.AdvRefs, error)
+	fetchPack(req *fetchRequest) (io.ReadCloser, error)
+}
+
+type fetchRequest struct {
+	wants []plumbing.Hash
+	haves []plumbing.Hash
+	depth int
+	// filter is a partial clone filter like "blob:none"
+	filter string
+}
+
+func newFetchRequest(req *common.GitUploadPackRequest) *fetchRequest {
+	return &fetchRequest{wants: req.Wants, haves: req.Haves, depth: req.Depth}
+}
+
+// encodeFetchRequest writes the wants, a flush and then the haves, the order servers expect.
+// The encoding in go-git sends the haves before the flush.
+func encodeFetchRequest(req *fetchRequest) io.Reader {
+	var capabilities []string
+	if req.depth != 0 {
+		capabilities = append(capabilities, "shallow")
+	}
+	if req.filter != "" {
+		capabilities = append(capabilities, "filter")
+	}
+
+	var buf bytes.Buffer
+	e := pktline.NewEncoder(&buf)
+	for i, want := range req.wants {
+		if i == 0 && len(capabilities) > 0 {
+			e.Encodef("want %s %s\n", want, strings.Join(capabilities, " "))
+			continue
+		}
+		e.Encodef("want %s\n", want)
+	}
+	if req.depth != 0 {
+		e.Encodef("deepen %d\n", req.depth)
+	}
+	if req.filter != "" {
+		e.Encodef("filter %s\n", req.filter)
+	}
+	e.Flush()
+	for _, have := range req.haves {
+		e.Encodef("have %s\n", have)
+	}
+	e.EncodeString("done\n")
+
+	return &buf
+}
+
+// decodeAdvertisedRefs decodes the refs a server advertises, keeping the commits annotated tags point to.
+func decodeAdvertisedRefs(raw []byte) (*advrefs.AdvRefs, error) {
+	ar := advrefs.New()
+	if err := advrefs.NewDecoder(bytes.NewReader(raw)).Decode(ar); err != nil {
+		return nil, err
+	}
+
+	return ar, nil
+}
+
+// readFetchResponse reads the lines the server sends before the packfile.
+func readFetchResponse(r io.Reader) error {
+	s := pktline.NewScanner(r)
+	for s.Scan() {
+		line := string(bytes.TrimSuffix(s.Bytes(), []byte("\n")))
+		switch {
+		case line == "", strings.HasPrefix(line, "shallow "), strings.HasPrefix(line, "unshallow "):
+			// Shallow updates end with a flush, the acknowledgement follows
+			continue
+		case line == "NAK", strings.HasPrefix(line, "ACK "):
+			return nil
+		case strings.HasPrefix(line, "ERR "):
+			return fmt.Errorf("Server refused fetch: %s", strings.TrimPrefix(line, "ERR "))
+		default:
+			return fmt.Errorf("Unexpected response from server: %q", line)
+		}
+	}
+	if s.Err() != nil {
+		return s.Err()
+	}
+
+	return io.ErrUnexpectedEOF
+}
+
+// httpUploadPack fetches over the smart HTTP protocol.
+type httpUploadPack struct {
+	endpoint common.Endpoint
+	auth     GitAuth
+	// method describes where the credentials came from, for errors
+	method   string
+	user     string
+	password string
+}
+
+func newHTTPUploadPack(endpoint common.Endpoint) common.GitUploadPackService {
+	return &httpUploadPack{endpoint: endpoint, auth: gitAuthFor(endpoint)}
+}
+
+func (s *httpUploadPack) Connect() error {
+	var err error
+	s.user, s.password, s.method, err = s.auth.basicAuth(s.endpoint)
+	if err != nil {
+		return fmt.Errorf("Failed to get credentials for %s: %s", s.endpoint.Host, err)
+	}
+	s.endpoint.User = nil
+
+	return nil
+}
+
+func (s *httpUploadPack) SetAuth(auth common.AuthMethod) error {
+	return common.ErrInvalidAuthMethod
+}
+
+func (s *httpUploadPack) infoRefs() ([]byte, error) {
+	res, err := s.do("GET", "/info/refs?service="+common.GitUploadPackServiceName, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	return ioutil.ReadAll(res.Body)
+}
+
+func (s *httpUploadPack) Info() (*common.GitUploadPackInfo, error) {
+	raw, err := s.infoRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	info := common.NewGitUploadPackInfo()
+	return info, info.Decode(bytes.NewReader(raw))
+}
+
+func (s *httpUploadPack) advertisedRefs() (*advrefs.AdvRefs, error) {
+	raw, err := s.infoRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeAdvertisedRefs(raw)
+}
+
+func (s *httpUploadPack) Fetch(req *common.GitUploadPackRequest) (io.ReadCloser, error) {
+	return s.fetchPack(newFetchRequest(req))
+}
+
+func (s *httpUploadPack) fetchPack(req *fetchRequest) (io.ReadCloser, error) {
+	res, err := s.do("POST", "/"+common.GitUploadPackServiceName, encodeFetchRequest(req))
+	if err != nil {
+		return nil, err
+	}
+	if err := readFetchResponse(res.Body); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+func (s *httpUploadPack) Disconnect() error {
+	return nil
+}
+
+func (s *httpUploadPack) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.endpoint.String()+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "git/1.0")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+		req.Header.Set("Accept", "application/x-git-upload-pack-result")
+	}
+	if s.user != "" || s.password != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		res.Body.Close()
+		return nil, fmt.Errorf("Authentication to %s with %s failed: %s", req.URL.Host, s.method, common.ErrAuthorizationRequired)
+	case res.StatusCode == http.StatusNotFound:
+		res.Body.Close()
+		return nil, common.ErrRepositoryNotFound
+	case res.StatusCode < 200 || res.StatusCode >= 300:
+		res.Body.Close()
+		return nil, fmt.Errorf("Unexpected status %s from %s", res.Status, req.URL.Host)
+	}
+
+	return res, nil
+}
+
+// sshUploadPack fetches by running git-upload-pack over SSH.
+type sshUploadPack struct {
+	endpoint common.Endpoint
+	auth     GitAuth
+	client   *ssh.Client
+}
+
+func newSSHUploadPack(endpoint common.Endpoint) common.GitUploadPackService {
+	return &sshUploadPack{endpoint: endpoint, auth: gitAuthFor(endpoint)}
+}
+
+func (s *sshUploadPack) Connect() error {
+	user := "git"
+	if s.endpoint.User != nil && s.endpoint.User.Username() != "" {
+		user = s.endpoint.User.Username()
+	}
+	host := s.endpoint.Host
+	if !strings.Contains(host, ":") {
+		host += ":22"
+	}
+
+	hostKeys, err := s.auth.hostKeyCallback()
+	if err != nil {
+		return err
+	}
+
+	var method string
+	var auth ssh.AuthMethod
+	if s.auth.SSHKey != "" {
+		method = "SSH key " + s.auth.SSHKey
+		signer, err := s.auth.sshKeySigner()
+		if err != nil {
+			return fmt.Errorf("Failed to read %s: %s", method, err)
+		}
+		auth = ssh.PublicKeys(signer)
+	} else {
+		method = "SSH agent"
+		conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			return fmt.Errorf("Failed to connect to SSH agent: %s", err)
+		}
+		defer conn.Close()
+		auth = ssh.PublicKeysCallback(agent.NewClient(conn).Signers)
+	}
+
+	s.client, err = ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKeys,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to connect to %s as %s with %s: %s", host, user, method, err)
+	}
+
+	return nil
+}
+
+func (s *sshUploadPack) SetAuth(auth common.AuthMethod) error {
+	return common.ErrInvalidAuthMethod
+}
+
+func (s *sshUploadPack) command() string {
+	return fmt.Sprintf("git-upload-pack '%s'", strings.TrimPrefix(s.endpoint.Path, "/"))
+}
+
+func (s *sshUploadPack) infoRefs() ([]byte, error) {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	// Without input the server stops after advertising its refs, with exit status 128
+	out, err := session.Output(s.command())
+	if exitErr, ok := err.(*ssh.ExitError); err != nil && !(ok && exitErr.ExitStatus() == 128) {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (s *sshUploadPack) Info() (*common.GitUploadPackInfo, error) {
+	raw, err := s.infoRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	info := common.NewGitUploadPackInfo()
+	return info, info.Decode(bytes.NewReader(raw))
+}
+
+func (s *sshUploadPack) advertisedRefs() (*advrefs.AdvRefs, error) {
+	raw, err := s.infoRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeAdvertisedRefs(raw)
+}
+
+func (s *sshUploadPack) Fetch(req *common.GitUploadPackRequest) (io.ReadCloser, error) {
+	return s.fetchPack(newFetchRequest(req))
+}
+
+func (s *sshUploadPack) fetchPack(req *fetchRequest) (io.ReadCloser, error) {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.Start(s.command()); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	// The refs are advertised again before the server reads the request
+	if err := advrefs.NewDecoder(stdout).Decode(advrefs.New()); err != nil {
+		session.Close()
+		return nil, err
+	}
+	if _, err := io.Copy(stdin, encodeFetchRequest(req)); err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdin.Close()
+	if err := readFetchResponse(stdout); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return &sshPack{Reader: stdout, session: session}, nil
+}
+
+func (s *sshUploadPack) Disconnect() error {
+	if s.client == nil {
+		return nil
+	}
+
+	return s.client.Close()
+}
+
+// sshPack is the packfile of a fetch, closing it waits for git-upload-pack to exit.
+type sshPack struct {
+	io.Reader
+	session *ssh.Session
+}
+
+func (p *sshPack) Close() error {
+	err := p.session.Wait()
+	p.session.Close()
+
+	return err
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-openapi/spec"
+	"k8s.io/client-go/pkg/api"
+	"k8s.io/client-go/pkg/api/resource"
+	"k8s.io/client-go/pkg/api/unversioned"
+	"k8s.io/client-go/pkg/runtime"
+	"k8s.io/client-go/pkg/util/intstr"
+)
+
+// Finding is a problem found while validating a manifest.
+type Finding struct {
+	Manifest *Manifest
+	Line     int
+	Path     string
+	Message  string
+	// Warning is set for things that can't be checked, they don't fail the validation.
+	Warning bool
+}
+
+func (f *Finding) String() string {
+	location := fmt.Sprintf("%s:%d", f.Manifest.File, f.Line)
+	if f.Manifest.Repository != "" {
+		location = f.Manifest.Repository + ": " + location
+	}
+	if f.Warning {
+		location = "warning: " + location
+	}
+	if f.Path == "" {
+		return fmt.Sprintf("%s: %s %s: %s", location, f.Manifest.Object.GetKind(), f.Manifest.Object.GetName(), f.Message)
+	}
+
+	return fmt.Sprintf("%s: %s %s: %s: %s", location, f.Manifest.Object.GetKind(), f.Manifest.Object.GetName(), f.Path, f.Message)
+}
+
+// Validator checks objects against OpenAPI schemas, without talking to the cluster.
+// The schemas for built in kinds are generated from the API types bundled with client-go,
+// custom resources are checked against the openAPIV3Schema of their CRD.
+type Validator struct {
+	definitions spec.Definitions
+	kinds       map[string]*spec.Schema
+}
+
+// NewValidator builds the schemas for every kind registered in the client-go scheme.
+func NewValidator() *Validator {
+	v := &Validator{
+		definitions: make(spec.Definitions),
+		kinds:       make(map[string]*spec.Schema),
+	}
+
+	for gvk, t := range api.Scheme.AllKnownTypes() {
+		if gvk.Version == runtime.APIVersionInternal {
+			continue
+		}
+		schema := v.schemaFor(t)
+		v.kinds[gvk.GroupVersion().String()+"/"+gvk.Kind] = &schema
+	}
+
+	return v
+}
+
+// AddCRD registers the schema of a CustomResourceDefinition.
+// Without an openAPIV3Schema any custom resource of its kind is valid.
+func (v *Validator) AddCRD(crd *runtime.Unstructured) error {
+	schema := &spec.Schema{}
+	if validation := nestedField(crd.Object, "spec", "validation", "openAPIV3Schema"); validation != nil {
+		data, err := json.Marshal(validation)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, schema); err != nil {
+			return fmt.Errorf("Invalid openAPIV3Schema in %s: %s", crd.GetName(), err)
+		}
+	}
+
+	group, _ := nestedField(crd.Object, "spec", "group").(string)
+	version, _ := nestedField(crd.Object, "spec", "version").(string)
+	kind, _ := nestedField(crd.Object, "spec", "names", "kind").(string)
+	v.kinds[group+"/"+version+"/"+kind] = schema
+
+	return nil
+}
+
+// Validate checks a manifest and returns what is wrong with it.
+// CRDs are read by AddCRD, an object of another kind there is no schema for can't be checked and gets a warning.
+func (v *Validator) Validate(m *Manifest) []*Finding {
+	if m.Object.GetKind() == "CustomResourceDefinition" {
+		return nil
+	}
+	schema, ok := v.kinds[m.Object.GetAPIVersion()+"/"+m.Object.GetKind()]
+	if !ok {
+		return []*Finding{{
+			Manifest: m,
+			Line:     m.Line,
+			Message:  fmt.Sprintf("no schema for %s in %s, it can't be validated", m.Object.GetKind(), m.Object.GetAPIVersion()),
+			Warning:  true,
+		}}
+	}
+
+	var findings []*Finding
+	for _, problem := range v.validate(m.Object.Object, schema, nil) {
+		findings = append(findings, &Finding{
+			Manifest: m,
+			Line:     m.Line + fieldLine(m.Source, problem.path),
+			Path:     joinPath(problem.path),
+			Message:  problem.message,
+		})
+	}
+
+	return findings
+}
+
+type problem struct {
+	path    []string
+	message string
+}
+
+func (v *Validator) validate(value interface{}, schema *spec.Schema, path []string) []problem {
+	if ref := schema.Ref.String(); ref != "" {
+		resolved, ok := v.definitions[strings.TrimPrefix(ref, "#/definitions/")]
+		if !ok {
+			return nil
+		}
+		schema = &resolved
+	}
+	if value == nil {
+		return nil
+	}
+
+	if len(schema.Type) > 0 && !matchesType(value, schema.Type) {
+		return []problem{{path, fmt.Sprintf("expected %s, got %s", strings.Join(schema.Type, " or "), typeName(value))}}
+	}
+
+	var problems []problem
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, e := range schema.Enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, problem{path, fmt.Sprintf("%v is not one of %v", value, schema.Enum)})
+		}
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		for _, required := range schema.Required {
+			if _, ok := val[required]; !ok {
+				problems = append(problems, problem{path, fmt.Sprintf("missing required field %s", required)})
+			}
+		}
+
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldPath := append(append([]string{}, path...), key)
+			if property, ok := schema.Properties[key]; ok {
+				problems = append(problems, v.validate(val[key], &property, fieldPath)...)
+				continue
+			}
+			if schema.AdditionalProperties == nil {
+				continue
+			}
+			if schema.AdditionalProperties.Schema != nil {
+				problems = append(problems, v.validate(val[key], schema.AdditionalProperties.Schema, fieldPath)...)
+			} else if !schema.AdditionalProperties.Allows {
+				problems = append(problems, problem{fieldPath, "unknown field"})
+			}
+		}
+	case []interface{}:
+		if schema.Items != nil && schema.Items.Schema != nil {
+			for i, item := range val {
+				itemPath := append(append([]string{}, path...), fmt.Sprintf("[%d]", i))
+				problems = append(problems, v.validate(item, schema.Items.Schema, itemPath)...)
+			}
+		}
+		if schema.MinItems != nil && int64(len(val)) < *schema.MinItems {
+			problems = append(problems, problem{path, fmt.Sprintf("must have at least %d items", *schema.MinItems)})
+		}
+		if schema.MaxItems != nil && int64(len(val)) > *schema.MaxItems {
+			problems = append(problems, problem{path, fmt.Sprintf("must have at most %d items", *schema.MaxItems)})
+		}
+	case string:
+		if schema.MinLength != nil && int64(len(val)) < *schema.MinLength {
+			problems = append(problems, problem{path, fmt.Sprintf("must be at least %d characters", *schema.MinLength)})
+		}
+		if schema.MaxLength != nil && int64(len(val)) > *schema.MaxLength {
+			problems = append(problems, problem{path, fmt.Sprintf("must be at most %d characters", *schema.MaxLength)})
+		}
+		if schema.Pattern != "" {
+			if re, err := regexp.Compile(schema.Pattern); err == nil && !re.MatchString(val) {
+				problems = append(problems, problem{path, fmt.Sprintf("does not match %s", schema.Pattern)})
+			}
+		}
+	case int64, float64:
+		number := toFloat(val)
+		if schema.Minimum != nil && number < *schema.Minimum {
+			problems = append(problems, problem{path, fmt.Sprintf("must be at least %v", *schema.Minimum)})
+		}
+		if schema.Maximum != nil && number > *schema.Maximum {
+			problems = append(problems, problem{path, fmt.Sprintf("must be at most %v", *schema.Maximum)})
+		}
+	}
+
+	return problems
+}
+
+func matchesType(value interface{}, types spec.StringOrArray) bool {
+	for _, t := range types {
+		switch t {
+		case "object":
+			if _, ok := value.(map[string]interface{}); ok {
+				return true
+			}
+		case "array":
+			if _, ok := value.([]interface{}); ok {
+				return true
+			}
+		case "string":
+			if _, ok := value.(string); ok {
+				return true
+			}
+		case "boolean":
+			if _, ok := value.(bool); ok {
+				return true
+			}
+		case "integer":
+			switch n := value.(type) {
+			case int64:
+				return true
+			case float64:
+				if n == float64(int64(n)) {
+					return true
+				}
+			}
+		case "number":
+			switch value.(type) {
+			case int64, float64:
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int64:
+		return "integer"
+	case float64:
+		return "number"
+	}
+
+	return fmt.Sprintf("%T", value)
+}
+
+func toFloat(value interface{}) float64 {
+	switch n := value.(type) {
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+
+	return 0
+}
+
+var (
+	timeType         = reflect.TypeOf(unversioned.Time{})
+	durationType     = reflect.TypeOf(unversioned.Duration{})
+	quantityType     = reflect.TypeOf(resource.Quantity{})
+	intOrStringType  = reflect.TypeOf(intstr.IntOrString{})
+	rawExtensionType = reflect.TypeOf(runtime.RawExtension{})
+	unmarshalerType  = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// schemaFor generates the schema of a Go API type from its JSON tags.
+// Structs are added to the definitions and referenced, so recursive types work.
+func (v *Validator) schemaFor(t reflect.Type) spec.Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	// Types that serialize themselves
+	switch t {
+	case timeType, durationType:
+		return typeSchema("string")
+	case quantityType:
+		return typeSchema("string", "integer", "number")
+	case intOrStringType:
+		return typeSchema("integer", "string")
+	case rawExtensionType:
+		return spec.Schema{}
+	}
+	if t.Kind() == reflect.Struct && reflect.PtrTo(t).Implements(unmarshalerType) {
+		return spec.Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return typeSchema("string")
+	case reflect.Bool:
+		return typeSchema("boolean")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return typeSchema("integer")
+	case reflect.Float32, reflect.Float64:
+		return typeSchema("number")
+	case reflect.Slice:
+		// []byte is base64 encoded
+		if t.Elem().Kind() == reflect.Uint8 {
+			return typeSchema("string")
+		}
+		items := v.schemaFor(t.Elem())
+		schema := typeSchema("array")
+		schema.Items = &spec.SchemaOrArray{Schema: &items}
+		return schema
+	case reflect.Map:
+		values := v.schemaFor(t.Elem())
+		schema := typeSchema("object")
+		schema.AdditionalProperties = &spec.SchemaOrBool{Allows: true, Schema: &values}
+		return schema
+	case reflect.Struct:
+		name := t.PkgPath() + "." + t.Name()
+		if _, ok := v.definitions[name]; !ok {
+			// Register before filling in the properties to stop recursion
+			v.definitions[name] = spec.Schema{}
+			schema := typeSchema("object")
+			schema.Properties = make(map[string]spec.Schema)
+			schema.AdditionalProperties = &spec.SchemaOrBool{Allows: false}
+			v.addFields(t, &schema)
+			v.definitions[name] = schema
+		}
+		return spec.Schema{SchemaProps: spec.SchemaProps{Ref: spec.MustCreateRef("#/definitions/" + name)}}
+	}
+
+	return spec.Schema{}
+}
+
+// addFields adds the JSON fields of a struct to schema, including those of inlined structs.
+func (v *Validator) addFields(t reflect.Type, schema *spec.Schema) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+
+		inline := false
+		for _, option := range parts[1:] {
+			if option == "inline" {
+				inline = true
+			}
+		}
+		if inline || field.Anonymous && name == "" {
+			fieldType := field.Type
+			for fieldType.Kind() == reflect.Ptr {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() == reflect.Struct {
+				v.addFields(fieldType, schema)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = v.schemaFor(field.Type)
+	}
+}
+
+// joinPath formats a field path like spec.containers[0].name.
+func joinPath(path []string) string {
+	var out string
+	for _, key := range path {
+		if strings.HasPrefix(key, "[") || out == "" {
+			out += key
+		} else {
+			out += "." + key
+		}
+	}
+
+	return out
+}
+
+func typeSchema(types ...string) spec.Schema {
+	return spec.Schema{SchemaProps: spec.SchemaProps{Type: spec.StringOrArray(types)}}
+}
+
+// fieldLine finds the line of a field in a YAML document by looking for each key of the path in turn.
+// It returns the offset from the start of the document, 0 if the field isn't found.
+func fieldLine(source []byte, path []string) int {
+	lines := strings.Split(string(source), "\n")
+	found := 0
+	current := 0
+	for _, key := range path {
+		if strings.HasPrefix(key, "[") {
+			continue
+		}
+		for i := current; i < len(lines); i++ {
+			trimmed := strings.TrimLeft(strings.TrimSpace(lines[i]), "- ")
+			if strings.HasPrefix(trimmed, key+":") || strings.HasPrefix(trimmed, "\""+key+"\":") {
+				found = i
+				current = i + 1
+				break
+			}
+		}
+	}
+
+	return found
+}
+
+// validateDeploy renders every repository at the ref a deploy would use and validates all objects.
+// CRDs in any of the repositories are used to validate the custom resources they define.
+func validateDeploy(repos []Repository, envMap map[string]string, updateRepo, updateRepoRef string) ([]*Finding, error) {
+	manifests, err := namespaceManifests(envMap)
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := renderLocal(envMap)
+	if err != nil {
+		return nil, err
+	}
+	manifests = append(manifests, local...)
+
+	for _, repo := range repos {
+		refName, _, _, err := resolveRef(stdLogger, repo, statePath(repo), updateRepo, updateRepoRef)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve the ref of %s: %s", repo.URI, err)
+		}
+		_, rendered, err := renderRepository(stdLogger, repo, refName, envMap)
+		if err != nil {
+			return nil, fmt.Errorf("Failure while cloning files for %s: %s", repo.URI, err)
+		}
+		manifests = append(manifests, rendered...)
+	}
+
+	validator := NewValidator()
+	for _, m := range manifests {
+		if m.Object.GetKind() == "CustomResourceDefinition" {
+			if err := validator.AddCRD(m.Object); err != nil {
+				return nil, fmt.Errorf("%s: %s", m, err)
+			}
+		}
+	}
+
+	var findings []*Finding
+	for _, m := range manifests {
+		findings = append(findings, validator.Validate(m)...)
+	}
+
+	return findings, nil
+}
+
+func printFindings(w io.Writer, findings []*Finding) {
+	for _, finding := range findings {
+		fmt.Fprintln(w, finding)
+	}
+	fmt.Fprintf(w, "\n%d problems found, %d warnings\n", countProblems(findings), len(findings)-countProblems(findings))
+}
+
+// countProblems returns the number of findings that are not warnings.
+func countProblems(findings []*Finding) int {
+	count := 0
+	for _, finding := range findings {
+		if !finding.Warning {
+			count++
+		}
+	}
+
+	return count
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// runID names the workspace of this run, so runs sharing a baseDir don't touch each other's files.
+var runID = newRunID()
+
+func newRunID() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+
+	return fmt.Sprintf("%s-%d-%s", time.Now().UTC().Format("20060102-150405"), os.Getpid(), hex.EncodeToString(b))
+}
+
+func workspacesDir() string {
+	return filepath.Join(config.BaseDir, "workspaces")
+}
+
+// repoWorkspace returns the directory the files of a commit of a repository are written to in this run.
+func repoWorkspace(uri, commit string) string {
+	return filepath.Join(workspacesDir(), runID, uriDirName(uri), commit)
+}
+
+// openWorkspace creates the workspace of this run and locks it while the deployer runs.
+// The returned function removes it again, unless workspaces are retained.
+func openWorkspace(retention time.Duration) (func(), error) {
+	dir := filepath.Join(workspacesDir(), runID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	unlock, err := lockFile(dir+".lock", false)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to lock workspace %s: %s", dir, err)
+	}
+
+	return func() {
+		if retention == 0 {
+			os.RemoveAll(dir)
+			os.Remove(dir + ".lock")
+		} else {
+			// Retention counts from the end of the run
+			now := time.Now()
+			os.Chtimes(dir+".lock", now, now)
+		}
+		unlock()
+	}, nil
+}
+
+// pruneWorkspaces removes the workspaces of runs that ended more than retention ago,
+// including those of runs that exited before cleaning up. Workspaces of running deployers are skipped.
+func pruneWorkspaces(retention time.Duration) error {
+	entries, err := ioutil.ReadDir(workspacesDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(workspacesDir(), entry.Name())
+
+		lastUsed := entry.ModTime()
+		if info, err := os.Stat(path + ".lock"); err == nil {
+			lastUsed = info.ModTime()
+		}
+		if time.Since(lastUsed) < retention {
+			continue
+		}
+
+		unlock, err := lockFile(path+".lock", false)
+		if err != nil {
+			continue
+		}
+		log.Println("Removing workspace:", entry.Name())
+		err = os.RemoveAll(path)
+		os.Remove(path + ".lock")
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}